@@ -0,0 +1,181 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lenye/aichat/internal/billing"
+	"github.com/lenye/aichat/internal/config"
+)
+
+var billingCmd = &cobra.Command{
+	Use:   "billing",
+	Short: "Inspect and top up the per-user token balances",
+	Args:  cobra.NoArgs,
+	RunE:  billingListRun,
+}
+
+var billingShowCmd = &cobra.Command{
+	Use:   "show <user>",
+	Short: "Show a user's balance and recent ledger entries",
+	Args:  cobra.ExactArgs(1),
+	RunE:  billingShowRun,
+}
+
+var billingTopUpCmd = &cobra.Command{
+	Use:   "topup <user> <amount>",
+	Short: "Add to a user's balance, a negative amount deducts",
+	Args:  cobra.ExactArgs(2),
+	RunE:  billingTopUpRun,
+}
+
+var (
+	flagBillingEntries int    // 显示的账目条数
+	flagBillingNote    string // 充值的备注
+)
+
+func init() {
+	billingShowCmd.Flags().IntVarP(&flagBillingEntries, "entries", "n", 20, "number of recent ledger entries to show, 0 = all")
+	billingTopUpCmd.Flags().StringVar(&flagBillingNote, "note", "", "note of the top up")
+	billingCmd.AddCommand(billingShowCmd, billingTopUpCmd)
+	root.AddCommand(billingCmd)
+}
+
+// openLedger 读取配置，打开账目
+func openLedger(cmd *cobra.Command) (billing.Ledger, error) {
+	if err := loadConfig(cmd); err != nil {
+		return nil, err
+	}
+	// 只需要会话存储和计费的配置，不需要上游的 api key
+	if err := config.SetupBilling(cfg); err != nil {
+		return nil, err
+	}
+	return billing.Open(cfg.Store.Dir)
+}
+
+func billingListRun(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage, cmd.SilenceErrors = true, true
+	ledger, err := openLedger(cmd)
+	if err != nil {
+		return err
+	}
+	defer ledger.Close()
+
+	list, err := ledger.Accounts()
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Println("no accounts")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tBALANCE\tSPENT\tREQUESTS\tTOKENS\tMONTH TOKENS\tUPDATED")
+	now := time.Now()
+	for _, a := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%s\n",
+			a.User,
+			billing.FormatAmount(a.Balance),
+			billing.FormatAmount(a.Spent),
+			a.Requests,
+			a.PromptTokens+a.CompletionTokens,
+			a.TokensIn(now),
+			a.UpdatedAt.Local().Format(time.DateTime),
+		)
+	}
+	return w.Flush()
+}
+
+func billingShowRun(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage, cmd.SilenceErrors = true, true
+	ledger, err := openLedger(cmd)
+	if err != nil {
+		return err
+	}
+	defer ledger.Close()
+
+	user := args[0]
+	a, err := ledger.Account(user)
+	if err != nil {
+		return err
+	}
+	if a.Entries == 0 {
+		return fmt.Errorf("no account: %q", user)
+	}
+	printAccount(a)
+
+	entries, err := ledger.Entries(user)
+	if err != nil {
+		return err
+	}
+	if n := flagBillingEntries; n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTYPE\tMODEL\tPROMPT\tCOMPLETION\tAMOUNT\tNOTE")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			e.Time.Local().Format(time.DateTime),
+			e.Type,
+			e.Model,
+			e.PromptTokens,
+			e.CompletionTokens,
+			billing.FormatAmount(e.Amount),
+			e.Note,
+		)
+	}
+	return w.Flush()
+}
+
+func billingTopUpRun(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage, cmd.SilenceErrors = true, true
+	amount, err := billing.ParseAmount(args[1])
+	if err == nil && amount == 0 {
+		err = errors.New("amount must not be 0")
+	}
+	if err != nil {
+		return err
+	}
+
+	ledger, err := openLedger(cmd)
+	if err != nil {
+		return err
+	}
+	defer ledger.Close()
+
+	a, err := billing.TopUp(ledger, args[0], amount, flagBillingNote)
+	if err != nil {
+		return err
+	}
+	printAccount(a)
+	return nil
+}
+
+func printAccount(a *billing.Account) {
+	fmt.Printf("user:         %s\n", a.User)
+	fmt.Printf("balance:      %s\n", billing.FormatAmount(a.Balance))
+	fmt.Printf("spent:        %s\n", billing.FormatAmount(a.Spent))
+	fmt.Printf("requests:     %d\n", a.Requests)
+	fmt.Printf("tokens:       %d prompt, %d completion\n", a.PromptTokens, a.CompletionTokens)
+	fmt.Printf("month tokens: %d\n", a.TokensIn(time.Now()))
+}
@@ -0,0 +1,270 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/pkg/project"
+)
+
+// envPrefix 环境变量的前缀，环境变量的名称为 AICHAT_ + 大写的参数名称，例如 AICHAT_OPENAI_API_KEY
+const envPrefix = "AICHAT_"
+
+var (
+	flagConfig      string        // 配置文件
+	flagConfigWatch time.Duration // 检查配置文件变化的间隔
+
+	configFile   string              // 使用的配置文件
+	flagChanged  map[string]string   // 命令行设置过的参数
+	flagSlices   map[string][]string // 命令行设置过的列表参数，String() 不能再次 Set
+	flagBackends config.Backends     // 命令行设置的后端
+)
+
+// noEnvFlags 不能用环境变量设置的参数
+var noEnvFlags = map[string]bool{
+	"help":    true,
+	"version": true,
+	"config":  true,
+}
+
+// envName 参数对应的环境变量名称
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// loadConfig 按优先级合并配置: 命令行参数 > 环境变量 > 配置文件 > 默认值
+//
+// 命令行参数已经写入 cfg，先记下设置过的参数，读取配置文件和环境变量之后再重新设置。
+// 配置文件: --config, 环境变量 AICHAT_CONFIG, 程序运行目录中的 aichat.{yaml,yml,json,toml}
+func loadConfig(cmd *cobra.Command) error {
+	flags := cmd.Flags()
+	// 子命令没有 root 的配置参数，同样适用环境变量
+	if r := cmd.Root(); cmd != r {
+		flags.AddFlagSet(r.Flags())
+	}
+
+	flagChanged = make(map[string]string)
+	flagSlices = make(map[string][]string)
+	flagBackends = cfg.Backends
+	flags.Visit(func(f *pflag.Flag) {
+		flagChanged[f.Name] = f.Value.String()
+		if v, ok := f.Value.(pflag.SliceValue); ok {
+			flagSlices[f.Name] = v.GetSlice()
+		}
+	})
+
+	configFile = flagConfig
+	if configFile == "" {
+		configFile = os.Getenv(envName("config"))
+	}
+	if configFile == "" {
+		configFile = config.FindFile(cfg.App.Dir)
+	}
+	return applyConfig(cfg, flags)
+}
+
+// applyConfig 依次把配置文件、环境变量和命令行设置过的参数写入 c，flags 是绑定到 c 的参数
+func applyConfig(c *config.Configuration, flags *pflag.FlagSet) error {
+	// 配置文件
+	if configFile != "" {
+		if err := config.LoadFile(c, configFile); err != nil {
+			return err
+		}
+		slog.Debug("config file loaded",
+			"file", configFile,
+		)
+	}
+
+	// 环境变量
+	var errs []error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if _, ok := flagChanged[f.Name]; ok || noEnvFlags[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := setFlag(f, value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid environment variable %s: %q, cause: %w", envName(f.Name), value, err))
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	// 命令行参数
+	for name, value := range flagChanged {
+		if flags.Lookup(name) == nil {
+			continue
+		}
+		if name == "backend" {
+			c.Backends = slices.Clone(flagBackends)
+			continue
+		}
+		if v, ok := flags.Lookup(name).Value.(pflag.SliceValue); ok {
+			if err := v.Replace(flagSlices[name]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupConfig 处理系统提示语的转义，校验配置并设置为默认配置
+func setupConfig(c *config.Configuration) error {
+	if !c.OpenAI.SystemRaw {
+		var err error
+		c.OpenAI.System, err = project.StrRaw2Interpreted(c.OpenAI.System)
+		if err != nil {
+			return config.InvalidKey("openai.system", c.OpenAI.System, err)
+		}
+	}
+	return config.Setup(c)
+}
+
+// restartKeys 修改后需要重启才能生效的配置；
+// web 只有监听地址和 https 需要重启，metrics、ready_probe、drain_timeout 每次使用时读取
+var restartKeys = []string{
+	"app.",
+	"web.port",
+	"web.listen",
+	"web.unix_socket_mode",
+	"web.tls.",
+	"store.",
+	"tracing.",
+}
+
+// reloadMu 配置文件的监视和 SIGHUP 可能同时重新加载配置
+var reloadMu sync.Mutex
+
+// reloadConfig 重新读取配置文件和环境变量，校验通过后替换默认配置，
+// 已经开始的请求继续使用原来的配置
+func reloadConfig(logger *slog.Logger) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	next := config.New(appPath)
+	flags, persistentFlags := configFlags(next)
+	flags.AddFlagSet(persistentFlags)
+	if err := applyConfig(next, flags); err != nil {
+		logger.Error("reload config failed",
+			"error", err,
+		)
+		return
+	}
+
+	prev := config.Default()
+	if err := setupConfig(next); err != nil {
+		logger.Error("reload config failed",
+			"error", err,
+		)
+		return
+	}
+	logger = slog.Default()
+
+	changes := config.Diff(prev, next)
+	logger.Info("config reloaded",
+		"file", configFile,
+		"changes", changes,
+	)
+	for _, change := range changes {
+		for _, prefix := range restartKeys {
+			if strings.HasPrefix(change, prefix) {
+				logger.Warn("config change requires a restart to take effect",
+					"change", change,
+				)
+			}
+		}
+	}
+}
+
+// watchConfig 每隔 interval 检查配置文件，修改时间或大小变化时重新加载
+func watchConfig(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	if configFile == "" || interval <= 0 {
+		return
+	}
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(configFile)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+	modTime, size := stat()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mt, sz := stat()
+			if sz < 0 || (mt.Equal(modTime) && sz == size) {
+				continue
+			}
+			modTime, size = mt, sz
+			logger.Info("config file changed",
+				"file", configFile,
+			)
+			reloadConfig(logger)
+		}
+	}
+}
+
+// setFlag 用环境变量设置参数，--backend 可以用 ; 分隔多个后端，替换配置文件中的后端
+func setFlag(f *pflag.Flag, value string) error {
+	if v, ok := f.Value.(*config.Backends); ok {
+		*v = nil
+		for _, b := range strings.Split(value, ";") {
+			if strings.TrimSpace(b) == "" {
+				continue
+			}
+			if err := v.Set(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// 列表参数: 逗号分隔，替换配置文件中的值
+	if v, ok := f.Value.(pflag.SliceValue); ok {
+		var list []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		return v.Replace(list)
+	}
+	return f.Value.Set(value)
+}
@@ -15,6 +15,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
@@ -22,17 +23,26 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 
 	"github.com/lenye/aichat/assets"
+	"github.com/lenye/aichat/internal/billing"
 	"github.com/lenye/aichat/internal/chatgpt"
 	"github.com/lenye/aichat/internal/config"
 	"github.com/lenye/aichat/internal/console"
+	"github.com/lenye/aichat/internal/conversation"
 	"github.com/lenye/aichat/internal/router"
 	"github.com/lenye/aichat/pkg/project"
+	"github.com/lenye/aichat/pkg/systemd"
+	"github.com/lenye/aichat/pkg/tracing"
 	"github.com/lenye/aichat/pkg/version"
+	"github.com/lenye/aichat/pkg/web/auth"
+	"github.com/lenye/aichat/pkg/web/certs"
+	"github.com/lenye/aichat/pkg/web/drain"
 	"github.com/lenye/aichat/pkg/web/render"
 	"github.com/lenye/aichat/pkg/web/sse"
 )
@@ -58,6 +68,11 @@ var root = &cobra.Command{
 // flagRunningMode 控制台模式
 var flagRunningMode string
 
+var (
+	flagSession  string // 命令行会话名称
+	flagContinue bool   // 继续最近的命令行会话
+)
+
 const (
 	consoleMode = "console"
 	webMode     = "web"
@@ -69,7 +84,7 @@ func Execute() {
 
 	if err := root.Execute(); err != nil {
 		logger := slog.Default()
-		logger.Error("invalid command flags",
+		logger.Error("aichat failed",
 			"error", err,
 		)
 		// fmt.Println(err)
@@ -89,24 +104,97 @@ func init() {
 	// console 控制台模式
 	root.Flags().StringVar(&flagRunningMode, "mode", "console", "running mode: console, web")
 
+	flags, persistentFlags := configFlags(cfg)
+	root.Flags().AddFlagSet(flags)
+	root.PersistentFlags().AddFlagSet(persistentFlags)
+
+	// 配置文件
+	root.PersistentFlags().StringVarP(&flagConfig, "config", "c", "", "config file: yaml, json, toml, default is aichat.{yaml,yml,json,toml} in the app directory")
+	root.Flags().DurationVar(&flagConfigWatch, "config_watch", 0, "reload the config file when it changes, check interval, e.g. 5s, 0 = only on SIGHUP")
+
+	// console 会话
+	root.Flags().StringVar(&flagSession, "session", "", "console session name to resume or create")
+	root.Flags().BoolVar(&flagContinue, "continue", false, "continue the most recent console session")
+
+}
+
+// configFlags 绑定到配置 c 的参数，重新加载配置时绑定到新的配置
+func configFlags(c *config.Configuration) (flags, persistentFlags *pflag.FlagSet) {
+	flags = pflag.NewFlagSet("config", pflag.ContinueOnError)
+	persistentFlags = pflag.NewFlagSet("config", pflag.ContinueOnError)
+
 	// openai
-	root.Flags().StringVar(&cfg.OpenAI.ApiType, "openai_api_type", string(openai.APITypeOpenAI), "openai api type: open_ai, azure")
-	root.Flags().StringVar(&cfg.OpenAI.ApiKey, "openai_api_key", "", "openai api key (required)")
-	_ = root.MarkFlagRequired("openai_api_key")
-	root.Flags().StringVar(&cfg.OpenAI.ApiBaseUrl, "openai_api_base_url", "", "openai api base url")
-	root.Flags().StringVar(&cfg.OpenAI.Proxy, "openai_proxy", "", "openai proxy")
-	root.Flags().StringVar(&cfg.OpenAI.Model, "openai_model", openai.GPT3Dot5Turbo, "openai chat message model")
-	root.Flags().StringVar(&cfg.OpenAI.System, "openai_system", "", "openai chat message system prompt")
-	root.Flags().BoolVar(&cfg.OpenAI.SystemRaw, "openai_system_raw", false, "openai chat message system prompt without any escape processing")
-	root.Flags().BoolVar(&cfg.OpenAI.Stream, "openai_stream", true, "openai chat message stream mode")
-	root.Flags().UintVar(&cfg.OpenAI.MaxTokens, "openai_max_tokens", 0, "openai chat message max tokens")
-	root.Flags().UintVar(&cfg.OpenAI.History, "openai_history", 0, "openai chat message history")
+	flags.StringVar(&c.OpenAI.ApiType, "openai_api_type", string(openai.APITypeOpenAI), "openai api type: open_ai, azure, anthropic, ollama, gemini")
+	flags.StringVar(&c.OpenAI.ApiKey, "openai_api_key", "", "openai api key (required, except for ollama)")
+	flags.StringVar(&c.OpenAI.ApiBaseUrl, "openai_api_base_url", "", "openai api base url")
+	flags.StringVar(&c.OpenAI.Proxy, "openai_proxy", "", "openai proxy")
+	flags.StringVar(&c.OpenAI.Model, "openai_model", openai.GPT3Dot5Turbo, "openai chat message model")
+	flags.StringVar(&c.OpenAI.System, "openai_system", "", "openai chat message system prompt")
+	flags.BoolVar(&c.OpenAI.SystemRaw, "openai_system_raw", false, "openai chat message system prompt without any escape processing")
+	flags.BoolVar(&c.OpenAI.Stream, "openai_stream", true, "openai chat message stream mode")
+	flags.UintVar(&c.OpenAI.MaxTokens, "openai_max_tokens", 0, "openai chat message max tokens")
+	flags.UintVar(&c.OpenAI.History, "openai_history", 0, "openai chat message history")
+	flags.UintVar(&c.OpenAI.ContextWindow, "openai_context_window", 0, "openai model context window in tokens, 0 = detect by model")
+	flags.UintVar(&c.OpenAI.SummaryThreshold, "openai_summary_threshold", 0, "summarize old chat history when it exceeds this many messages, 0 = disabled")
+	flags.StringVar(&c.OpenAI.OllamaKeepAlive, "ollama_keep_alive", "", "ollama keep model loaded in memory for this duration, e.g. 5m, -1")
+	flags.UintVar(&c.OpenAI.OllamaNumCtx, "ollama_num_ctx", 0, "ollama model context window in tokens")
+	flags.StringVar(&c.OpenAI.SummaryModel, "openai_summary_model", "", "openai model used to summarize old chat history, default is the chat model")
+
+	// 命名的后端
+	flags.Var(&c.Backends, "backend", "named backend, repeatable: name=xx,type=open_ai,key=xx,url=xx,proxy=xx,models=gpt-4*|o1*,fallback=default|local:llama3")
+	flags.UintVar(&c.Failover.Threshold, "failover_threshold", 3, "eject a backend after this many consecutive failures, 0 = never")
+	flags.DurationVar((*time.Duration)(&c.Failover.Cooldown), "failover_cooldown", 30*time.Second, "how long an ejected backend is skipped")
+	flags.UintVar(&c.Retry.MaxAttempts, "retry_max_attempts", 3, "max attempts per backend on transient errors (429, 5xx, timeout), 1 = no retry")
+	flags.DurationVar((*time.Duration)(&c.Retry.Deadline), "retry_deadline", time.Minute, "stop retrying after this long since the first attempt, 0 = no limit")
+
+	// 兼容 openai api 的网关
+	flags.StringSliceVar(&c.Gateway.Keys, "gateway_key", nil, "client api key of the openai compatible gateway /v1, repeatable: user:key or key (user gateway), empty = gateway disabled")
+
+	// web 登录认证
+	flags.StringVar(&c.Auth.Password, "auth_password", "", "web login shared password")
+	flags.StringVar(&c.Auth.Htpasswd, "auth_htpasswd", "", "web login users, htpasswd file with bcrypt passwords (htpasswd -B)")
+	flags.StringSliceVar(&c.Auth.Tokens, "auth_token", nil, "bearer token for the web api, repeatable: user:token")
+	flags.StringVar(&c.Auth.SessionKey, "auth_session_key", "", "web login session cookie signing key, default is random on every start")
+	flags.DurationVar((*time.Duration)(&c.Auth.SessionTTL), "auth_session_ttl", auth.DefaultSessionTTL, "web login session lifetime")
+	flags.BoolVar(&c.Auth.SecureCookie, "auth_secure_cookie", false, "send the web login session cookie over https only")
+
+	// 计费
+	flags.BoolVar(&c.Billing.Enabled, "billing", false, "record token usage per user, refuse chats when the balance or quota is exhausted")
+	flags.Var(&c.Billing.Prices, "billing_price", "model price per 1M tokens, repeatable: model=input/output, e.g. gpt-4o*=2.5/10")
+	flags.Float64Var(&c.Billing.InitialBalance, "billing_initial_balance", 0, "balance of a new user")
+	flags.Uint64Var(&c.Billing.TokenQuota, "billing_token_quota", 0, "tokens per user per month, 0 = unlimited")
+
+	// web 聊天的限流
+	flags.Var(&c.RateLimit.Rules, "rate_limit", "web chat rate limit per user or ip, repeatable: group=default,route=/chat/msg,requests=20,tokens=100000,streams=2; requests per minute, tokens per day, empty route = shared by all chat routes")
+	flags.Var(&c.RateLimit.Groups, "rate_limit_group", "user group of the rate limits, repeatable: name=user1|user2")
+
+	// 链路追踪
+	flags.StringVar(&c.Tracing.Exporter, "trace_exporter", "none", "opentelemetry trace exporter: none, stdout, file, otlp")
+	flags.StringVar(&c.Tracing.Endpoint, "trace_endpoint", "", "otlp http endpoint, e.g. http://localhost:4318, default from OTEL_EXPORTER_OTLP_* env")
+	flags.StringVar(&c.Tracing.File, "trace_file", "", "file of the file trace exporter, one span per line in json")
+	flags.Float64Var(&c.Tracing.SampleRatio, "trace_sample_ratio", 1, "trace sample ratio 0~1, follows the sampling of an incoming traceparent")
+
+	// 会话存储
+	persistentFlags.StringVar(&c.Store.Type, "store_type", "file", "conversation store type: file, bolt")
+	persistentFlags.StringVar(&c.Store.Dir, "store_dir", "", "conversation store directory, default is the app directory")
 
 	// web server 在console模式下不用
-	root.Flags().UintVar(&cfg.Web.Port, "web_port", 8080, "web server listen port")
+	flags.UintVar(&c.Web.Port, "web_port", 8080, "web server listen port")
+	flags.StringSliceVar(&c.Web.Listen, "web_listen", nil, "web server listen address, repeatable: 127.0.0.1:8080, unix:/run/aichat.sock, systemd, systemd:name; default :web_port or the systemd sockets")
+	flags.StringVar(&c.Web.UnixSocketMode, "web_unix_socket_mode", "", "file mode of the unix sockets, e.g. 0660")
+	flags.BoolVar(&c.Web.Metrics, "web_metrics", false, "serve prometheus metrics at /metrics without login, keep it off the public network")
+	flags.StringVar(&c.Web.TLS.CertFile, "web_tls_cert", "", "https certificate file (pem, may include intermediates), reloaded when changed; empty = http")
+	flags.StringVar(&c.Web.TLS.KeyFile, "web_tls_key", "", "https private key file (pem)")
+	flags.StringVar(&c.Web.TLS.MinVersion, "web_tls_min_version", "1.2", "https minimum tls version: 1.0, 1.1, 1.2, 1.3")
+	flags.StringVar(&c.Web.TLS.ClientCA, "web_tls_client_ca", "", "ca bundle to verify https client certificates, the certificate CN becomes the user")
+	flags.StringVar(&c.Web.TLS.ClientAuth, "web_tls_client_auth", certs.ClientAuthRequire, "https client certificate: require, optional (verify if given)")
+	flags.BoolVar(&c.Web.ReadyProbe, "web_ready_probe", false, "readiness check /readyz also probes the upstream by listing models")
+	flags.DurationVar((*time.Duration)(&c.Web.DrainTimeout), "web_drain_timeout", 30*time.Second, "on SIGTERM, stop accepting new chats and wait this long for active chats to finish")
 	// web log 在console模式下不用
-	root.Flags().StringVar(&cfg.Log.Level, "log_level", "info", "log message level: debug, info, warn, error")
-	root.Flags().StringVar(&cfg.Log.Format, "log_format", "text", "log message encode format: text, json")
+	flags.StringVar(&c.Log.Level, "log_level", "info", "log message level: debug, info, warn, error")
+	flags.StringVar(&c.Log.Format, "log_format", "text", "log message encode format: text, json")
+
+	return flags, persistentFlags
 }
 
 func rootRun(cmd *cobra.Command, args []string) {
@@ -118,29 +206,48 @@ func rootRun(cmd *cobra.Command, args []string) {
 	}
 
 	logger := slog.Default()
-	if err := config.Setup(cfg); err != nil {
+	if err := loadConfig(cmd); err != nil {
+		logger.Error("load config failed",
+			"error", err,
+		)
+		return
+	}
+	if err := setupConfig(cfg); err != nil {
 		logger = slog.Default()
 		logger.Error("config setup failed",
 			"error", err,
 		)
 		return
 	}
+	logger = slog.Default()
 
 	if project.DevMode() {
 		cfg.Print()
 	}
 
-	if !cfg.OpenAI.SystemRaw {
-		var err error
-		cfg.OpenAI.System, err = project.StrRaw2Interpreted(cfg.OpenAI.System)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	store, err := conversation.Open(cfg.Store.Type, cfg.Store.Dir)
+	if err != nil {
+		logger.Error("open conversation store failed",
+			"error", err,
+		)
+		return
+	}
+	defer store.Close()
+	conversation.SetDefault(store)
+
+	// 计费的账目
+	ledger, err := billing.Open(cfg.Store.Dir)
+	if err != nil {
+		logger.Error("open billing ledger failed",
+			"error", err,
+		)
+		return
 	}
+	defer ledger.Close()
+	billing.SetDefaultLedger(ledger)
 
 	if strings.ToLower(flagRunningMode) == consoleMode {
-		cli, err := chatgpt.NewOpenAIClient(cfg.OpenAI.ApiKey, cfg.OpenAI.ApiType, cfg.OpenAI.ApiBaseUrl, cfg.OpenAI.Proxy)
+		cli, err := chatgpt.NewProvider(cfg)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -151,8 +258,15 @@ func rootRun(cmd *cobra.Command, args []string) {
 			Stream:    cfg.OpenAI.Stream,
 			History:   cfg.OpenAI.History,
 			MaxTokens: cfg.OpenAI.MaxTokens,
+
+			ContextWindow: cfg.OpenAI.ContextWindow,
+		}
+		conv, err := console.OpenSession(store, flagSession, flagContinue, in)
+		if err != nil {
+			fmt.Println(err)
+			return
 		}
-		console.Chat(cli, in)
+		console.Chat(cli, cfg.OpenAI, in, store, conv)
 	} else {
 		// html 模板
 		render.SetDebug(project.DevMode())
@@ -164,6 +278,24 @@ func rootRun(cmd *cobra.Command, args []string) {
 			return
 		}
 
+		// 链路追踪
+		shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Tracing())
+		if err != nil {
+			logger.Error("tracing.Setup failed",
+				"error", err,
+			)
+			return
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownTracing(ctx); err != nil {
+				logger.Error("tracing shutdown failed",
+					"error", err,
+				)
+			}
+		}()
+
 		wg := new(sync.WaitGroup)
 
 		sseServer := sse.Default()
@@ -176,18 +308,92 @@ func rootRun(cmd *cobra.Command, args []string) {
 		if err != nil {
 			return
 		}
+		// systemd Type=notify
+		notify(systemd.Ready, logger)
+
+		// 配置文件变化时重新加载
+		watchCtx, stopWatch := context.WithCancel(context.Background())
+		defer stopWatch()
+		go watchConfig(watchCtx, flagConfigWatch, logger)
 
 		signalChan := make(chan os.Signal, 1)
-		signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+		signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 		defer signal.Stop(signalChan)
 
-		s := <-signalChan
-		logger.Debug("received signal",
-			"signal", s,
-		)
+		var sig os.Signal
+		for sig = range signalChan {
+			logger.Debug("received signal",
+				"signal", sig,
+			)
+			if sig != syscall.SIGHUP {
+				break
+			}
+			// SIGHUP 重新加载配置
+			reloadConfig(logger)
+			logger = slog.Default()
+		}
 
+		notify(systemd.Stopping, logger)
+		// SIGTERM 等待进行中的聊天结束
+		if sig == syscall.SIGTERM {
+			drainWeb(signalChan, logger)
+		}
+		// 关闭 sse 连接，否则 http server 要等到超时
+		sseServer.Close()
 		config.WebShutdown(httpd, logger)
 
 		wg.Wait()
 	}
 }
+
+// drainWeb 不再接受新的聊天，通知页面服务器正在关闭，
+// 等待进行中的聊天结束，最多等待 web_drain_timeout；期间再次收到 SIGINT、SIGTERM 时立即停止等待
+func drainWeb(signalChan <-chan os.Signal, logger *slog.Logger) {
+	d := drain.Default()
+	d.Start()
+
+	timeout := time.Duration(config.Default().Web.DrainTimeout)
+	logger.Info("web server draining",
+		"active", d.Active(),
+		"timeout", timeout,
+	)
+	sse.Default().Broadcast(&sse.Event{
+		Event: []byte("shutdown"),
+		Data:  []byte("[[服务器正在关闭，进行中的回复完成后将断开连接]]"),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case s := <-signalChan:
+				if s != syscall.SIGHUP {
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if err := d.Drain(ctx); err != nil {
+		logger.Warn("web server drain incomplete, closing active chats",
+			"active", d.Active(),
+			"error", err,
+		)
+		return
+	}
+	logger.Info("web server drained")
+}
+
+// notify 通知 systemd 服务的状态，不是 systemd 启动时忽略
+func notify(state string, logger *slog.Logger) {
+	if _, err := systemd.Notify(state); err != nil {
+		logger.Warn("sd_notify failed",
+			"state", state,
+			"error", err,
+		)
+	}
+}
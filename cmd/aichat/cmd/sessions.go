@@ -0,0 +1,55 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/internal/console"
+	"github.com/lenye/aichat/internal/conversation"
+)
+
+var sessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "List saved console sessions",
+	Args:  cobra.NoArgs,
+	RunE:  sessionsRun,
+}
+
+func init() {
+	root.AddCommand(sessionsCmd)
+}
+
+func sessionsRun(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage, cmd.SilenceErrors = true, true
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	// 只需要会话存储，不需要上游的 api key
+	if err := config.SetupStore(cfg); err != nil {
+		return err
+	}
+
+	store, err := conversation.Open(cfg.Store.Type, cfg.Store.Dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	return console.PrintSessions(os.Stdout, store)
+}
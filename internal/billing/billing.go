@@ -0,0 +1,213 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package billing tokens 用量的计费和每个用户的账目
+//
+// 金额使用整数，单位为 Micro（0.000001），价格为每 1M tokens 的金额，
+// 因此 tokens 数乘以价格就是以 Micro 为单位的金额。
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Micro 金额 1 对应的 Micro 数
+const Micro = 1_000_000
+
+// AnonymousUser 不需要登录时记账的用户
+const AnonymousUser = "anonymous"
+
+var (
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrQuotaExceeded       = errors.New("monthly token quota exceeded")
+)
+
+// Price 模型的价格，每 1M tokens 的金额
+type Price struct {
+	Model  string  // 模型名称，支持 path.Match 通配符，如 gpt-4o*
+	Input  float64 // 提示语
+	Output float64 // 回复
+}
+
+// Cost 用量的金额，单位为 Micro
+func (p *Price) Cost(usage openai.Usage) int64 {
+	return int64(math.Round(float64(usage.PromptTokens)*p.Input + float64(usage.CompletionTokens)*p.Output))
+}
+
+// Policy 计费策略
+type Policy struct {
+	Enabled        bool
+	Prices         []Price // 先精确匹配模型名称，再按顺序匹配通配符；都不匹配时不收费，只计入 tokens 额度
+	InitialBalance int64   // 新用户的初始余额，单位为 Micro
+	TokenQuota     int64   // 每个用户每月的 tokens 额度，0=不限制
+}
+
+// Price 模型的价格
+func (p *Policy) Price(model string) (*Price, bool) {
+	for i := range p.Prices {
+		if p.Prices[i].Model == model {
+			return &p.Prices[i], true
+		}
+	}
+	for i := range p.Prices {
+		if ok, _ := path.Match(p.Prices[i].Model, model); ok {
+			return &p.Prices[i], true
+		}
+	}
+	return nil, false
+}
+
+var (
+	defaultPolicy atomic.Value
+	defaultLedger atomic.Value
+)
+
+func init() {
+	defaultPolicy.Store(new(Policy))
+}
+
+// Default returns the default Policy.
+func Default() *Policy {
+	return defaultPolicy.Load().(*Policy)
+}
+
+// SetDefault makes v the default Policy.
+func SetDefault(v *Policy) {
+	defaultPolicy.Store(v)
+}
+
+// DefaultLedger returns the default Ledger.
+func DefaultLedger() Ledger {
+	v, _ := defaultLedger.Load().(Ledger)
+	return v
+}
+
+// SetDefaultLedger makes v the default Ledger.
+func SetDefaultLedger(v Ledger) {
+	defaultLedger.Store(v)
+}
+
+// Open 打开账目，dir=存储目录
+func Open(dir string) (Ledger, error) {
+	return NewFileLedger(filepath.Join(dir, "ledger"))
+}
+
+// Enabled 是否计费
+func Enabled() bool {
+	return Default().Enabled && DefaultLedger() != nil
+}
+
+func userName(user string) string {
+	if user == "" {
+		return AnonymousUser
+	}
+	return user
+}
+
+// account 读取账户，新用户先记入初始余额
+func account(l Ledger, p *Policy, user string) (*Account, error) {
+	a, err := l.Account(user)
+	if err != nil {
+		return nil, err
+	}
+	if a.Entries == 0 && p.InitialBalance > 0 {
+		return l.Append(user, &Entry{
+			Time:   time.Now(),
+			Type:   EntryGrant,
+			Amount: p.InitialBalance,
+			Note:   "initial balance",
+		})
+	}
+	return a, nil
+}
+
+// Check 提问前检查用户的余额和每月的 tokens 额度
+func Check(user string) error {
+	p, l := Default(), DefaultLedger()
+	if !p.Enabled || l == nil {
+		return nil
+	}
+	a, err := account(l, p, userName(user))
+	if err != nil {
+		return fmt.Errorf("read account failed, cause: %w", err)
+	}
+	if p.TokenQuota > 0 && a.TokensIn(time.Now()) >= p.TokenQuota {
+		return ErrQuotaExceeded
+	}
+	if len(p.Prices) > 0 && a.Balance <= 0 {
+		return ErrInsufficientBalance
+	}
+	return nil
+}
+
+// Charge 按模型的价格记录一次聊天的用量，返回记账后的账户
+func Charge(user, model string, usage openai.Usage) (*Entry, *Account, error) {
+	p, l := Default(), DefaultLedger()
+	if !p.Enabled || l == nil {
+		return nil, nil, nil
+	}
+	e := &Entry{
+		Time:             time.Now(),
+		Type:             EntryUsage,
+		Model:            model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+	}
+	if price, ok := p.Price(model); ok {
+		e.Amount = -price.Cost(usage)
+	}
+	a, err := l.Append(userName(user), e)
+	if err != nil {
+		return nil, nil, fmt.Errorf("append ledger failed, cause: %w", err)
+	}
+	return e, a, nil
+}
+
+// TopUp 充值，amount 为负数时为扣减，单位为 Micro
+func TopUp(l Ledger, user string, amount int64, note string) (*Account, error) {
+	user = userName(user)
+	// 新用户先记入初始余额
+	if _, err := account(l, Default(), user); err != nil {
+		return nil, err
+	}
+	return l.Append(user, &Entry{
+		Time:   time.Now(),
+		Type:   EntryTopUp,
+		Amount: amount,
+		Note:   note,
+	})
+}
+
+// ParseAmount 解析金额，如 10, 0.5, -2
+func ParseAmount(s string) (int64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid amount: %q", s)
+	}
+	return int64(math.Round(f * Micro)), nil
+}
+
+// FormatAmount 金额，单位为 Micro
+func FormatAmount(v int64) string {
+	return strconv.FormatFloat(float64(v)/Micro, 'f', 6, 64)
+}
@@ -0,0 +1,271 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package billing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lenye/aichat/pkg/project"
+)
+
+// 账目类型
+const (
+	EntryUsage = "usage" // 聊天的用量
+	EntryTopUp = "topup" // 充值，金额为负数时为扣减
+	EntryGrant = "grant" // 新用户的初始余额
+)
+
+// Entry 一条账目
+type Entry struct {
+	Time             time.Time `json:"time"`
+	Type             string    `json:"type"`
+	Model            string    `json:"model,omitempty"`
+	PromptTokens     int       `json:"prompt_tokens,omitempty"`
+	CompletionTokens int       `json:"completion_tokens,omitempty"`
+	Amount           int64     `json:"amount"` // 余额的变化，单位为 Micro，用量为负数
+	Note             string    `json:"note,omitempty"`
+}
+
+// Account 用户的账户，由全部账目累计得到
+type Account struct {
+	User             string    `json:"user"`
+	Balance          int64     `json:"balance"` // 余额，单位为 Micro
+	Spent            int64     `json:"spent"`   // 累计消费，单位为 Micro
+	PromptTokens     int64     `json:"prompt_tokens"`
+	CompletionTokens int64     `json:"completion_tokens"`
+	Requests         int64     `json:"requests"`
+	Month            string    `json:"month,omitempty"`        // 最近一条用量的月份 2006-01
+	MonthTokens      int64     `json:"month_tokens,omitempty"` // Month 月份的 tokens 用量
+	Entries          int64     `json:"entries"`                // 账目条数，0 为新用户
+	UpdatedAt        time.Time `json:"updated_at,omitempty"`
+}
+
+const monthLayout = "2006-01"
+
+func (a *Account) apply(e *Entry) {
+	a.Entries++
+	a.Balance += e.Amount
+	a.UpdatedAt = e.Time
+	if e.Type != EntryUsage {
+		return
+	}
+	a.Spent -= e.Amount
+	a.Requests++
+	a.PromptTokens += int64(e.PromptTokens)
+	a.CompletionTokens += int64(e.CompletionTokens)
+	if month := e.Time.Format(monthLayout); month != a.Month {
+		a.Month = month
+		a.MonthTokens = 0
+	}
+	a.MonthTokens += int64(e.PromptTokens + e.CompletionTokens)
+}
+
+// TokensIn 月份 t 的 tokens 用量
+func (a *Account) TokensIn(t time.Time) int64 {
+	if a.Month != t.Format(monthLayout) {
+		return 0
+	}
+	return a.MonthTokens
+}
+
+// Ledger 每个用户的账目
+type Ledger interface {
+	// Account 读取账户，用户不存在时返回空账户
+	Account(user string) (*Account, error)
+	// Append 追加账目，返回追加后的账户
+	Append(user string, e *Entry) (*Account, error)
+	// Entries 用户的全部账目，按时间顺序
+	Entries(user string) ([]*Entry, error)
+	// Accounts 全部账户，按用户名排序
+	Accounts() ([]*Account, error)
+	// Close 关闭账目
+	Close() error
+}
+
+const ledgerExt = ".jsonl"
+
+// FileLedger 每个用户的账目追加写入目录下的一个 jsonl 文件，账户由账目累计得到。
+//
+// 只追加不改写，管理命令和 web 服务同时写入同一个用户的账目也不会丢失；
+// 读取时从上次读到的位置继续，不需要每次读取全部账目。
+type FileLedger struct {
+	dir      string
+	mu       sync.Mutex
+	accounts map[string]*fileAccount
+}
+
+type fileAccount struct {
+	offset  int64 // 已读取的字节数
+	account Account
+}
+
+// NewFileLedger 创建 jsonl 文件账目
+func NewFileLedger(dir string) (*FileLedger, error) {
+	if err := project.CreateDir(dir); err != nil {
+		return nil, err
+	}
+	return &FileLedger{dir: dir, accounts: make(map[string]*fileAccount)}, nil
+}
+
+// filename 用户名转义后作为文件名
+func (l *FileLedger) filename(user string) string {
+	return filepath.Join(l.dir, url.QueryEscape(user)+ledgerExt)
+}
+
+// refresh 读取上次读取之后新增的账目，不完整的最后一行留到下次读取
+func (l *FileLedger) refresh(user string) (*Account, error) {
+	v, ok := l.accounts[user]
+	if !ok {
+		v = &fileAccount{account: Account{User: user}}
+		l.accounts[user] = v
+	}
+
+	f, err := os.Open(l.filename(user))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			a := v.account
+			return &a, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(v.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			break
+		}
+		line := b[:i]
+		b = b[i+1:]
+		v.offset += int64(i + 1)
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		e := new(Entry)
+		if err := json.Unmarshal(line, e); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal failed, ledger: %q, offset: %d, cause: %w", user, v.offset, err)
+		}
+		v.account.apply(e)
+	}
+	a := v.account
+	return &a, nil
+}
+
+func (l *FileLedger) Account(user string) (*Account, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.refresh(user)
+}
+
+func (l *FileLedger) Append(user string, e *Entry) (*Account, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// 一次 write 追加一行，多个进程同时追加时不会交错
+	f, err := os.OpenFile(l.filename(user), os.O_WRONLY|os.O_APPEND|os.O_CREATE, project.ModePerm0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return l.refresh(user)
+}
+
+func (l *FileLedger) Entries(user string) ([]*Entry, error) {
+	b, err := os.ReadFile(l.filename(user))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []*Entry
+	for _, line := range bytes.Split(b, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		e := new(Entry)
+		if err := json.Unmarshal(line, e); err != nil {
+			// 正在写入的最后一行
+			break
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+func (l *FileLedger) Accounts() ([]*Account, error) {
+	files, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var list []*Account
+	for _, f := range files {
+		name, ok := strings.CutSuffix(f.Name(), ledgerExt)
+		if f.IsDir() || !ok {
+			continue
+		}
+		user, err := url.QueryUnescape(name)
+		if err != nil {
+			continue
+		}
+		a, err := l.refresh(user)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].User < list[j].User
+	})
+	return list, nil
+}
+
+func (l *FileLedger) Close() error {
+	return nil
+}
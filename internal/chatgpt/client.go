@@ -15,98 +15,162 @@
 package chatgpt
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net/http"
-	"net/url"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sashabaranov/go-openai"
-)
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
-const (
-	Timeout = 180 * time.Second
+	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/internal/provider"
+	"github.com/lenye/aichat/pkg/tracing"
 )
 
-var defaultHTTPClient = &http.Client{
-	Timeout:   Timeout,
-	Transport: http.DefaultTransport,
+// breakers 后端的熔断器，按后端名称和熔断配置，在多次请求之间共享
+var breakers sync.Map // name/threshold/cooldown -> *provider.Breaker
+
+func breaker(name string, cfg *config.FailoverConfig) *provider.Breaker {
+	key := fmt.Sprintf("%s/%d/%s", name, cfg.Threshold, time.Duration(cfg.Cooldown))
+	v, _ := breakers.LoadOrStore(key, provider.NewBreaker(int(cfg.Threshold), time.Duration(cfg.Cooldown)))
+	return v.(*provider.Breaker)
+}
+
+// providers 最近一次按配置创建的提供方，配置不变时在请求之间共享，重新加载配置后重新创建
+var providers atomic.Pointer[cachedProvider]
+
+type cachedProvider struct {
+	cfg    *config.Configuration
+	router *provider.Router
 }
 
-// NewOpenAIClient 客户端
-func NewOpenAIClient(apiKey, apiType, baseURL, proxy string) (*openai.Client, error) {
-	if apiKey == "" {
-		return nil, errors.New("missed api key")
+// NewProvider 按配置创建聊天服务提供方，按请求的模型选择后端，临时错误时重试，失败时换用备用后端。
+// 同一个配置返回同一个提供方。
+func NewProvider(cfg *config.Configuration) (*provider.Router, error) {
+	if v := providers.Load(); v != nil && v.cfg == cfg {
+		return v.router, nil
 	}
-	if baseURL != "" {
-		if _, err := url.Parse(baseURL); err != nil {
-			return nil, fmt.Errorf("invalid base url: %q, cause %s", baseURL, err)
-		}
+	router, err := newRouter(cfg)
+	if err != nil {
+		return nil, err
 	}
-	var cfg openai.ClientConfig
+	providers.Store(&cachedProvider{cfg: cfg, router: router})
+	return router, nil
+}
 
-	APIType := openai.APIType(strings.ToUpper(apiType))
+func newRouter(cfg *config.Configuration) (*provider.Router, error) {
+	var backends []*provider.Backend
+	models := newModelLabels(cfg)
+	for _, b := range cfg.AllBackends() {
+		p, err := provider.New(provider.Config{
+			Type:    b.ApiType,
+			APIKey:  b.ApiKey,
+			BaseURL: b.ApiBaseUrl,
+			Proxy:   b.Proxy,
 
-	switch APIType {
-	case openai.APITypeOpenAI:
-		cfg = openai.DefaultConfig(apiKey)
-		if baseURL != "" {
-			cfg.BaseURL = baseURL
+			KeepAlive: b.OllamaKeepAlive,
+			NumCtx:    int(b.OllamaNumCtx),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("backend %q: %w", b.Name, err)
 		}
-	case openai.APITypeAzure:
-		if baseURL == "" {
-			return nil, errors.New("missed base url")
+		var fallback []provider.Fallback
+		for _, f := range b.Fallback {
+			fallback = append(fallback, provider.ParseFallback(f))
 		}
-		cfg = openai.DefaultAzureConfig(apiKey, baseURL)
-	default:
-		return nil, fmt.Errorf("invalid api type: %q", apiType)
+		backends = append(backends, &provider.Backend{
+			Name:     b.Name,
+			Models:   b.Models,
+			Fallback: fallback,
+			Provider: instrument(b.Name, models, p),
+			Breaker:  breaker(b.Name, cfg.Failover),
+		})
 	}
-
-	if proxy != "" {
-		proxyUrl, err := url.Parse(proxy)
-		if err != nil {
-			return nil, fmt.Errorf("invalid proxy: %q, cause %s", proxy, err)
-		}
-		defaultHTTPClient.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyUrl)
+	retry := provider.Retry{
+		MaxAttempts: int(cfg.Retry.MaxAttempts),
+		Deadline:    time.Duration(cfg.Retry.Deadline),
 	}
+	return provider.NewRouter(retry, backends...), nil
+}
 
-	cfg.HTTPClient = defaultHTTPClient
+// ErrPromptTooLong 系统提示语和用户提示语超过了上下文长度的预算
+var ErrPromptTooLong = errors.New("prompt too long")
 
-	return openai.NewClientWithConfig(cfg), nil
-}
+// PromptTooLongNotice ErrPromptTooLong 显示给用户的提示
+const PromptTooLongNotice = "[[提示语太长，超过了模型的上下文长度]]"
 
 // MakeChatRequest 生成请求消息, history=不含系统提示语的聊天记录
-func MakeChatRequest(in *Message, history []openai.ChatCompletionMessage) *openai.ChatCompletionRequest {
+//
+// 会话有摘要时，摘要紧跟在系统提示语之后。
+// 聊天记录先按 in.History 保留最近的条数，再按模型的上下文长度减去 MaxTokens 的预算，
+// 从最早的聊天记录开始删除或截断，Trimmed 返回被删除的部分。
+// 系统提示语和用户提示语本身超过预算时返回 ErrPromptTooLong，不发送请求。
+func MakeChatRequest(ctx context.Context, in *Message, history []openai.ChatCompletionMessage) (*openai.ChatCompletionRequest, Trimmed, error) {
+	_, span := tracing.Start(ctx, "chatgpt.MakeChatRequest",
+		trace.WithAttributes(tracing.AttrModel.String(in.Model)),
+	)
+	defer span.End()
+
 	var (
-		sysMsg  *openai.ChatCompletionMessage  // 系统提示语
 		chatMsg []openai.ChatCompletionMessage // 当前请求对话的聊天内容
+		trimmed Trimmed
 	)
 	// 系统提示语
 	if in.System != "" {
-		sysMsg = &openai.ChatCompletionMessage{
+		chatMsg = append(chatMsg, openai.ChatCompletionMessage{
 			Role:    openai.ChatMessageRoleSystem,
 			Content: in.System, // "you are a helpful chatbot"
-		}
-	}
-	// 系统提示语
-	if sysMsg != nil {
-		chatMsg = append(chatMsg, *sysMsg)
+		})
 	}
-	// 聊天记录
-	if in.History > 0 {
-		if len(history)/2 > int(in.History) {
-			history = history[2:]
-		}
-		chatMsg = append(chatMsg, history...)
+	// 较早聊天记录的摘要
+	if in.History > 0 && in.Summary != "" {
+		chatMsg = append(chatMsg, summaryMessage(in.Summary))
 	}
 	// 用户输入的提示语
 	uMsg := openai.ChatCompletionMessage{
 		Role:    openai.ChatMessageRoleUser,
 		Content: in.Prompt,
 	}
+
+	// tokens 预算 = 上下文长度 - 回复的tokens - 系统提示语和用户提示语的tokens
+	contextWindow := int(in.ContextWindow)
+	if contextWindow == 0 {
+		contextWindow = ContextWindow(in.Model)
+	}
+	reply := int(in.MaxTokens)
+	if reply == 0 {
+		reply = defaultReplyTokens
+	}
+	prompt := CountTokens(in.Model, append(chatMsg, uMsg))
+	budget := contextWindow - reply - prompt
+	if budget < 0 {
+		err := fmt.Errorf("%w: %d prompt tokens and %d reply tokens exceed the context window of %d tokens",
+			ErrPromptTooLong, prompt, reply, contextWindow)
+		tracing.Error(span, err, ErrCategoryBadRequest)
+		return nil, trimmed, err
+	}
+
+	// 聊天记录
+	if in.History > 0 {
+		if n := int(in.History) * 2; len(history) > n {
+			history = history[len(history)-n:]
+		}
+		history, trimmed = fitHistory(codecForModel(in.Model), history, budget)
+		chatMsg = append(chatMsg, history...)
+	}
 	chatMsg = append(chatMsg, uMsg)
 
+	span.SetAttributes(
+		attribute.Int("aichat.messages", len(chatMsg)),
+		attribute.Int("aichat.history.dropped", trimmed.Messages),
+		attribute.Int("aichat.history.truncated", trimmed.Truncated),
+		attribute.Int("aichat.history.trimmed_tokens", trimmed.Tokens),
+	)
+
 	return &openai.ChatCompletionRequest{
 		Temperature:      0.7,
 		TopP:             1,
@@ -118,5 +182,5 @@ func MakeChatRequest(in *Message, history []openai.ChatCompletionMessage) *opena
 		User:             in.User,
 		Model:            in.Model,
 		Messages:         chatMsg,
-	}
+	}, trimmed, nil
 }
@@ -0,0 +1,117 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatgpt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/internal/conversation"
+	"github.com/lenye/aichat/pkg/web/logging"
+)
+
+// summaryTimeout 后台生成摘要的超时时间
+const summaryTimeout = 2 * time.Minute
+
+// summarizing 正在后台生成摘要的会话，同一个会话同时只生成一次
+var summarizing sync.Map // id -> struct{}
+
+// SaveConversation 保存一轮聊天记录，聊天记录过长时在后台把较早的部分合并到会话摘要，不延迟回复
+func SaveConversation(ctx context.Context, conv *conversation.Conversation, prompt openai.ChatCompletionMessage, reply string) {
+	logger := logging.FromContext(ctx)
+
+	turn := []openai.ChatCompletionMessage{prompt, {
+		Role:    openai.ChatMessageRoleAssistant,
+		Content: reply,
+	}}
+	if err := conversation.Default().Append(conv.ID, turn...); err != nil {
+		logger.Error("save conversation failed",
+			"error", err,
+			"stream_id", conv.ID,
+		)
+		return
+	}
+	conv.Messages = append(conv.Messages, turn...)
+
+	if _, upto := conv.ToSummarize(config.Default().OpenAI.SummaryThreshold); upto == 0 {
+		return
+	}
+	go summarizeConversation(context.WithoutCancel(ctx), conv.ID)
+}
+
+// summarizeConversation 重新读取会话（包含其它请求同时追加的聊天记录）并生成摘要，只保存摘要，
+// 期间会话已被摘要或者清除时放弃
+func summarizeConversation(ctx context.Context, id string) {
+	if _, busy := summarizing.LoadOrStore(id, struct{}{}); busy {
+		return
+	}
+	defer summarizing.Delete(id)
+
+	ctx, cancel := context.WithTimeout(ctx, summaryTimeout)
+	defer cancel()
+	logger := logging.FromContext(ctx)
+
+	conv, err := conversation.Default().Load(id)
+	if err != nil {
+		logger.Error("load conversation failed",
+			"error", err,
+			"stream_id", id,
+		)
+		return
+	}
+	cfg := config.Default()
+	p, err := NewProvider(cfg)
+	if err != nil {
+		logger.Error("NewProvider failed",
+			"error", err,
+		)
+		return
+	}
+	from := conv.Summarized
+	ok, err := SummarizeConversation(ctx, p, cfg.OpenAI.SummaryModel, cfg.OpenAI.SummaryThreshold, conv)
+	if err != nil {
+		logger.Error("summarize conversation failed",
+			"error", err,
+			"stream_id", id,
+		)
+		return
+	}
+	if !ok {
+		return
+	}
+	if err := conversation.Default().UpdateSummary(id, from, conv.Summary, conv.Summarized); err != nil {
+		if errors.Is(err, conversation.ErrConflict) || errors.Is(err, conversation.ErrNotFound) {
+			logger.Warn("conversation changed, summary discarded",
+				"error", err,
+				"stream_id", id,
+			)
+			return
+		}
+		logger.Error("save conversation summary failed",
+			"error", err,
+			"stream_id", id,
+		)
+		return
+	}
+	logger.Info("conversation summarized",
+		"stream_id", id,
+		"summarized", conv.Summarized,
+	)
+}
@@ -0,0 +1,75 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatgpt
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrStopped 用户停止了生成
+var ErrStopped = errors.New("generation stopped")
+
+// Stopped 生成是否被用户停止
+func Stopped(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrStopped)
+}
+
+type generation struct {
+	user   string
+	cancel context.CancelCauseFunc
+}
+
+// generations 进行中的生成，键为 stream id + 生成 id
+var generations = struct {
+	sync.Mutex
+	m map[string]*generation
+}{m: make(map[string]*generation)}
+
+func generationKey(streamID, generationID string) string {
+	return streamID + "/" + generationID
+}
+
+// StartGeneration 登记一次可以停止的生成，返回的 ctx 在 StopGeneration 时取消，
+// 取消的原因为 ErrStopped；生成结束后调用 done。
+func StartGeneration(ctx context.Context, streamID, generationID, user string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	key := generationKey(streamID, generationID)
+
+	generations.Lock()
+	generations.m[key] = &generation{user: user, cancel: cancel}
+	generations.Unlock()
+
+	return ctx, func() {
+		generations.Lock()
+		delete(generations.m, key)
+		generations.Unlock()
+		cancel(nil)
+	}
+}
+
+// StopGeneration 停止进行中的生成，只能停止自己的；没有找到时返回 false
+func StopGeneration(streamID, generationID, user string) bool {
+	generations.Lock()
+	defer generations.Unlock()
+
+	g, ok := generations.m[generationKey(streamID, generationID)]
+	if !ok || g.user != user {
+		return false
+	}
+	g.cancel(ErrStopped)
+	return true
+}
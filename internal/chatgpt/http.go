@@ -15,6 +15,7 @@
 package chatgpt
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -22,10 +23,15 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/internal/provider"
+	"github.com/lenye/aichat/pkg/tracing"
 	"github.com/lenye/aichat/pkg/web/logging"
 	"github.com/lenye/aichat/pkg/web/sse"
 )
@@ -86,89 +92,278 @@ func chatErr(tag string, err error, chStr chan<- string, logger *slog.Logger) er
 	return err
 }
 
-// HttpChatCompletion 聊天api
+// 聊天请求错误的类别，和 chatErr 显示给用户的提示对应，用于指标
+const (
+	ErrCategoryBadRequest   = "bad_request"
+	ErrCategoryUnauthorized = "unauthorized"
+	ErrCategoryRateLimited  = "rate_limited"
+	ErrCategoryUnavailable  = "unavailable"
+	ErrCategoryTimeout      = "timeout"
+	ErrCategoryNetwork      = "network"
+	ErrCategoryCanceled     = "canceled"
+	ErrCategoryRefused      = "refused" // 余额或者额度不足，没有请求上游
+	ErrCategoryOther        = "other"
+)
+
+// ErrorCategory 聊天请求错误的类别
+func ErrorCategory(err error) string {
+	var (
+		reqErr *openai.RequestError
+		apiErr *openai.APIError
+		urlErr *url.Error
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrCategoryCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrCategoryTimeout
+	case errors.As(err, &reqErr):
+		return ErrCategoryBadRequest
+	case errors.As(err, &apiErr):
+		switch apiErr.HTTPStatusCode {
+		case 504, 500, 503:
+			return ErrCategoryUnavailable
+		case 429:
+			return ErrCategoryRateLimited
+		case 401:
+			return ErrCategoryUnauthorized
+		default:
+			return ErrCategoryBadRequest
+		}
+	case errors.As(err, &urlErr):
+		if urlErr.Timeout() {
+			return ErrCategoryTimeout
+		}
+		return ErrCategoryNetwork
+	}
+	return ErrCategoryOther
+}
+
+// ErrorStatus 聊天请求错误对应的 http 状态码: 上游返回的 4xx/5xx 原样返回，超时为 504，其它为 502
+func ErrorStatus(err error) int {
+	var (
+		reqErr *openai.RequestError
+		apiErr *openai.APIError
+		urlErr *url.Error
+	)
+	switch {
+	case errors.As(err, &apiErr):
+		if apiErr.HTTPStatusCode >= http.StatusBadRequest {
+			return apiErr.HTTPStatusCode
+		}
+	case errors.As(err, &reqErr):
+		if reqErr.HTTPStatusCode >= http.StatusBadRequest {
+			return reqErr.HTTPStatusCode
+		}
+	case errors.As(err, &urlErr):
+		if urlErr.Timeout() {
+			return http.StatusGatewayTimeout
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// HttpChatCompletion 聊天api, 返回的error不为nil时，表示聊天请求失败。
+// 提问前检查用户的余额和额度，结束后记录 tokens 用量。
 func HttpChatCompletion(r *http.Request,
-	cfg *config.OpenAIConfig,
+	cfg *config.Configuration,
 	req *openai.ChatCompletionRequest,
-	chStr chan<- string) {
-	ctx := r.Context()
+	chStr chan<- string) error {
+	notice, err := ChatCompletion(r.Context(), "chatgpt.HttpChatCompletion", cfg, req,
+		func(ctx context.Context, p provider.Provider) (*provider.Response, error) {
+			return ProviderChatCompletion(ctx, p, req, chStr)
+		})
+	if notice != "" {
+		chStr <- notice
+		close(chStr)
+	}
+	return err
+}
+
+// ChatCompletion 聊天的共用部分: 提问前检查用户的余额和额度，选择后端，结束后记录 tokens 用量，
+// 全部记录在名为 name 的 span。complete 用提供方完成聊天，返回已收到的回复，出错时也返回已收到的部分。
+//
+// 没有调用 complete 时（余额不足、创建提供方失败）返回显示给用户的提示 notice 和错误。
+func ChatCompletion(ctx context.Context,
+	name string,
+	cfg *config.Configuration,
+	req *openai.ChatCompletionRequest,
+	complete func(ctx context.Context, p provider.Provider) (*provider.Response, error)) (string, error) {
+	ctx, span := tracing.Start(ctx, name,
+		trace.WithAttributes(
+			tracing.AttrModel.String(req.Model),
+			tracing.AttrStream.Bool(req.Stream),
+		),
+	)
+	defer span.End()
+
 	logger := logging.FromContext(ctx)
-	logger.Debug("HttpChatCompletion",
+	logger.Debug("ChatCompletion",
 		"openai.ChatCompletionRequest", req,
 	)
 
-	client, err := NewOpenAIClient(cfg.ApiKey, cfg.ApiType, cfg.ApiBaseUrl, cfg.Proxy)
+	if notice, err := CheckBalance(ctx, req.User); err != nil {
+		logger.Warn("chat refused",
+			"error", err,
+			"user", req.User,
+		)
+		tracing.Error(span, err, ErrCategoryRefused)
+		return notice, err
+	}
+
+	p, err := NewProvider(cfg)
 	if err != nil {
-		logger.Error("NewOpenAIClient failed",
+		logger.Error("NewProvider failed",
 			"error", err,
-			"config", cfg,
 		)
-		chStr <- fmt.Sprintf("[[%s]]", err.Error())
-		close(chStr)
-		return
+		tracing.Error(span, err, ErrCategoryOther)
+		return fmt.Sprintf("[[%s]]", err.Error()), err
+	}
+
+	IncludeUsage(ctx, req)
+	resp, err := complete(ctx, p)
+	RecordUsage(ctx, req, resp)
+
+	if resp != nil && span.IsRecording() {
+		usage, _ := usageOf(req, resp.Usage, resp.Content)
+		span.SetAttributes(
+			tracing.AttrPromptTokens.Int(usage.PromptTokens),
+			tracing.AttrCompletionTokens.Int(usage.CompletionTokens),
+		)
+		if resp.FinishReason != "" {
+			span.SetAttributes(tracing.AttrFinishReason.String(string(resp.FinishReason)))
+		}
 	}
+	if Stopped(ctx) {
+		span.AddEvent("stopped")
+	} else {
+		tracing.Error(span, err, ErrorCategory(err))
+	}
+	return "", err
+}
+
+// ProviderChatCompletion 用提供方 p 完成聊天，回复内容写入 chStr，结束时关闭 chStr。
+// 返回已收到的回复和 tokens 用量，出错时也返回已收到的部分。
+func ProviderChatCompletion(ctx context.Context,
+	p provider.Provider,
+	req *openai.ChatCompletionRequest,
+	chStr chan<- string) (*provider.Response, error) {
+	logger := logging.FromContext(ctx)
 
 	if req.Stream {
-		streamReader, err := client.CreateChatCompletionStream(ctx, *req)
+		resp := new(provider.Response)
+		var sb strings.Builder
+		defer func() {
+			resp.Content = sb.String()
+		}()
+
+		start := time.Now()
+		stream, err := p.CreateChatStream(ctx, req)
 		if err != nil {
-			if err := chatErr("CreateChatCompletionStream failed", err, chStr, logger); err != nil {
-				logger.Error("CreateChatCompletionStream failed",
+			if Stopped(ctx) {
+				close(chStr)
+				return resp, err
+			}
+			if err := chatErr("CreateChatStream failed", err, chStr, logger); err != nil {
+				logger.Error("CreateChatStream failed",
 					"error", err.Error(),
 				)
 			}
 			close(chStr)
-			return
+			return resp, err
 		}
-		defer streamReader.Close()
+		defer stream.Close()
 
 		for {
 			select {
 			case <-ctx.Done():
 				// client close
 				close(chStr)
-				return
+				return resp, ctx.Err()
 			default:
 			}
 
-			resp, err := streamReader.Recv()
+			delta, err := stream.Recv()
 			if err != nil {
 				if errors.Is(err, io.EOF) {
 					// Stream finished
-				} else {
+					close(chStr)
+					return resp, nil
+				}
+				if Stopped(ctx) {
+					// 停止生成，不是错误
+					close(chStr)
+					return resp, err
+				}
+				logger.Error("read stream failed",
+					"error", err,
+				)
+				if err := chatErr("read stream failed", err, chStr, logger); err != nil {
 					logger.Error("read stream failed",
-						"error", err,
+						"error", err.Error(),
 					)
-					chStr <- fmt.Sprintf("[[%s]]", err.Error())
 				}
 				close(chStr)
-				return
+				return resp, err
 			}
 
 			logger.Debug("stream",
-				"response", resp,
+				"delta", delta,
 			)
 
-			for _, choice := range resp.Choices {
-				if choice.Delta.Content != "" {
-					chStr <- choice.Delta.Content
+			if delta.FinishReason != "" {
+				resp.FinishReason = delta.FinishReason
+			}
+			if delta.Usage != nil {
+				resp.Usage = *delta.Usage
+			}
+			if delta.Model != "" {
+				resp.Model = delta.Model
+			}
+			if delta.Content != "" {
+				if sb.Len() == 0 {
+					// 首个内容的时间，记录在调用方的 span
+					ttft := time.Since(start)
+					span := trace.SpanFromContext(ctx)
+					span.AddEvent("first token")
+					span.SetAttributes(tracing.AttrTTFT.Int64(ttft.Milliseconds()))
 				}
+				sb.WriteString(delta.Content)
+				chStr <- delta.Content
 			}
 		}
 	} else {
-		resp, err := client.CreateChatCompletion(ctx, *req)
+		resp, err := p.CreateChat(ctx, req)
 		if err != nil {
-			if err := chatErr("CreateChatCompletion failed", err, chStr, logger); err != nil {
-				logger.Error("CreateChatCompletion failed",
+			if Stopped(ctx) {
+				close(chStr)
+				return nil, err
+			}
+			if err := chatErr("CreateChat failed", err, chStr, logger); err != nil {
+				logger.Error("CreateChat failed",
 					"error", err,
 				)
 			}
-			chStr <- fmt.Sprintf("[[%s]]", err.Error())
 			close(chStr)
-			return
+			return nil, err
 		}
-		chStr <- resp.Choices[0].Message.Content
+		chStr <- resp.Content
 		close(chStr)
-		return
+		return resp, nil
+	}
+}
+
+// SSERetryNotify 重试时向 web 页面发送 notice 事件
+func SSERetryNotify(streamID string) provider.RetryNotify {
+	return func(backend string, attempt int, wait time.Duration, err error) {
+		notice := fmt.Sprintf("[[服务繁忙，%s 后第 %d 次重试]]", wait.Round(100*time.Millisecond), attempt)
+		sse.Default().Publish(streamID, &sse.Event{
+			Event: []byte("notice"),
+			Data:  []byte(notice),
+		})
 	}
 }
 
@@ -176,15 +371,28 @@ func HttpChatCompletion(r *http.Request,
 func SSEServerChatResponseProcess(r *http.Request,
 	streamID string,
 	chStr <-chan string) string {
-	ctx := r.Context()
-	var messages strings.Builder
+	ctx, span := tracing.Start(r.Context(), "sse.publish",
+		trace.WithAttributes(tracing.AttrStreamID.String(streamID)),
+	)
+	defer span.End()
+
+	var (
+		messages strings.Builder
+		events   int
+	)
+	defer func() {
+		span.SetAttributes(attribute.Int("aichat.sse.events", events))
+	}()
 	for {
 		select {
 		case <-ctx.Done():
+			discard(chStr)
 			return messages.String()
 		case str, ok := <-chStr:
 			if !ok {
 				sse.Default().Publish(streamID, &sse.Event{Data: []byte("<br><br>")})
+				// 清除重试的通知
+				sse.Default().Publish(streamID, &sse.Event{Event: []byte("notice"), Data: []byte(" ")})
 				// 已被关闭
 				return messages.String()
 			}
@@ -192,6 +400,7 @@ func SSEServerChatResponseProcess(r *http.Request,
 			str = strings.Replace(str, "\r", "", -1)
 			str = strings.Replace(str, "\n", "<br>", -1)
 			sse.Default().Publish(streamID, &sse.Event{Data: []byte(str)})
+			events++
 		}
 	}
 }
@@ -206,6 +415,7 @@ func HttpChatResponseProcess(w http.ResponseWriter, r *http.Request,
 	for {
 		select {
 		case <-ctx.Done():
+			discard(chStr)
 			return messages.String()
 		case str, ok := <-chStr:
 			if !ok {
@@ -218,9 +428,16 @@ func HttpChatResponseProcess(w http.ResponseWriter, r *http.Request,
 				logger.Error("write stream failed",
 					"error", err,
 				)
+				discard(chStr)
 				return ""
 			}
 			flusher.Flush()
 		}
 	}
 }
+
+// discard 停止生成或者客户端断开后，丢弃剩余的内容直到 chStr 关闭，避免 HttpChatCompletion 阻塞
+func discard(chStr <-chan string) {
+	for range chStr {
+	}
+}
@@ -24,4 +24,8 @@ type Message struct {
 	StreamID  string `json:"stream_id,omitempty"`
 	History   uint   `json:"history,omitempty"`
 	MaxTokens uint   `json:"max_tokens,omitempty"`
+
+	ContextWindow uint   `json:"context_window,omitempty"` // 模型上下文长度，0=按模型自动识别
+	Summary       string `json:"summary,omitempty"`        // 较早聊天记录的摘要
+	GenerationID  string `json:"generation_id,omitempty"`  // 本次生成的 id，用于停止生成
 }
@@ -0,0 +1,227 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatgpt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/internal/provider"
+	"github.com/lenye/aichat/pkg/web/metrics"
+)
+
+var (
+	upstreamRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upstream",
+		Name:      "requests_total",
+		Help:      "Upstream chat requests by backend, model and mode (stream, sync), including retries.",
+	}, []string{"backend", "model", "mode"})
+
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upstream",
+		Name:      "errors_total",
+		Help:      "Failed upstream chat requests by backend, model and error category.",
+	}, []string{"backend", "model", "category"})
+
+	upstreamTTFT = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upstream",
+		Name:      "time_to_first_token_seconds",
+		Help:      "Time from the upstream stream request to the first content.",
+		Buckets:   []float64{.1, .25, .5, 1, 2, 4, 8, 16, 32},
+	}, []string{"backend", "model"})
+
+	upstreamTokensPerSecond = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upstream",
+		Name:      "tokens_per_second",
+		Help:      "Completion tokens per second, for streams measured from the first content.",
+		Buckets:   []float64{1, 5, 10, 20, 40, 80, 160, 320},
+	}, []string{"backend", "model"})
+
+	promptTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "prompt_tokens_total",
+		Help:      "Prompt tokens by model, estimated by the tokenizer when the upstream reports no usage.",
+	}, []string{"model"})
+
+	completionTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "completion_tokens_total",
+		Help:      "Completion tokens by model, estimated by the tokenizer when the upstream reports no usage.",
+	}, []string{"model"})
+)
+
+func init() {
+	metrics.MustRegister(
+		upstreamRequests,
+		upstreamErrors,
+		upstreamTTFT,
+		upstreamTokensPerSecond,
+		promptTokens,
+		completionTokens,
+	)
+}
+
+// modelOther 不在配置中的模型的 model 标签
+const modelOther = "other"
+
+// modelLabels 指标的 model 标签: 配置中的模型名称，
+// 其它的模型（例如匹配 glob 模式或者没有模型列表的后端收到的任意模型名称）记为 other，标签的取值数量有限
+type modelLabels map[string]struct{}
+
+// newModelLabels 配置中的模型名称: 默认的模型、摘要的模型、后端的模型列表（不含 glob 模式）和备用后端的模型
+func newModelLabels(cfg *config.Configuration) modelLabels {
+	m := make(modelLabels)
+	add := func(model string) {
+		if model != "" {
+			m[model] = struct{}{}
+		}
+	}
+	add(cfg.OpenAI.Model)
+	add(cfg.OpenAI.SummaryModel)
+	for _, b := range cfg.AllBackends() {
+		for _, model := range b.Models {
+			if !strings.ContainsAny(model, `*?[\`) {
+				add(model)
+			}
+		}
+		for _, f := range b.Fallback {
+			add(provider.ParseFallback(f).Model)
+		}
+	}
+	return m
+}
+
+func (m modelLabels) of(model string) string {
+	if _, ok := m[model]; ok {
+		return model
+	}
+	return modelOther
+}
+
+// instrumented 记录后端每次请求（包括重试）的指标
+type instrumented struct {
+	provider.Provider
+	backend string
+	models  modelLabels
+}
+
+func instrument(backend string, models modelLabels, p provider.Provider) *instrumented {
+	return &instrumented{Provider: p, backend: backend, models: models}
+}
+
+func (p *instrumented) CreateChat(ctx context.Context, req *openai.ChatCompletionRequest) (*provider.Response, error) {
+	model := p.models.of(req.Model)
+	upstreamRequests.WithLabelValues(p.backend, model, "sync").Inc()
+	start := time.Now()
+	resp, err := p.Provider.CreateChat(ctx, req)
+	if err != nil {
+		upstreamErrors.WithLabelValues(p.backend, model, ErrorCategory(err)).Inc()
+		return nil, err
+	}
+	observeTokens(p.backend, model, req, resp.Usage, resp.Content, time.Since(start))
+	return resp, nil
+}
+
+func (p *instrumented) CreateChatStream(ctx context.Context, req *openai.ChatCompletionRequest) (provider.Stream, error) {
+	model := p.models.of(req.Model)
+	upstreamRequests.WithLabelValues(p.backend, model, "stream").Inc()
+	start := time.Now()
+	s, err := p.Provider.CreateChatStream(ctx, req)
+	if err != nil {
+		upstreamErrors.WithLabelValues(p.backend, model, ErrorCategory(err)).Inc()
+		return nil, err
+	}
+	return &instrumentedStream{Stream: s, backend: p.backend, model: model, req: req, start: start}, nil
+}
+
+// Models 转发给后端，后端不支持时返回 provider.ErrModelsUnsupported
+func (p *instrumented) Models(ctx context.Context) ([]string, error) {
+	return provider.Models(ctx, p.Provider)
+}
+
+// instrumentedStream 记录首个内容的时间，结束时记录 tokens
+type instrumentedStream struct {
+	provider.Stream
+	backend string
+	model   string // model 标签
+	req     *openai.ChatCompletionRequest
+	start   time.Time
+	first   time.Time
+	content strings.Builder
+	usage   openai.Usage
+	once    sync.Once
+}
+
+func (s *instrumentedStream) Recv() (*provider.Delta, error) {
+	delta, err := s.Stream.Recv()
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			upstreamErrors.WithLabelValues(s.backend, s.model, ErrorCategory(err)).Inc()
+		}
+		s.finish()
+		return delta, err
+	}
+	if delta.Content != "" {
+		if s.first.IsZero() {
+			s.first = time.Now()
+			upstreamTTFT.WithLabelValues(s.backend, s.model).Observe(s.first.Sub(s.start).Seconds())
+		}
+		s.content.WriteString(delta.Content)
+	}
+	if delta.Usage != nil {
+		s.usage = *delta.Usage
+	}
+	return delta, nil
+}
+
+// Close 客户端断开等原因提前关闭时，按已收到的部分记录
+func (s *instrumentedStream) Close() error {
+	s.finish()
+	return s.Stream.Close()
+}
+
+func (s *instrumentedStream) finish() {
+	s.once.Do(func() {
+		if s.first.IsZero() {
+			return
+		}
+		observeTokens(s.backend, s.model, s.req, s.usage, s.content.String(), time.Since(s.first))
+	})
+}
+
+// observeTokens 记录 tokens 和生成速度，上游没有返回用量时用 tokenizer 估算，model 为标签
+func observeTokens(backend, model string, req *openai.ChatCompletionRequest, usage openai.Usage, content string, d time.Duration) {
+	usage, _ = usageOf(req, usage, content)
+	if usage.PromptTokens == 0 && usage.CompletionTokens == 0 {
+		return
+	}
+	promptTokens.WithLabelValues(model).Add(float64(usage.PromptTokens))
+	completionTokens.WithLabelValues(model).Add(float64(usage.CompletionTokens))
+	if d > 0 && usage.CompletionTokens > 0 {
+		upstreamTokensPerSecond.WithLabelValues(backend, model).Observe(float64(usage.CompletionTokens) / d.Seconds())
+	}
+}
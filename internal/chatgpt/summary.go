@@ -0,0 +1,99 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatgpt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/lenye/aichat/internal/conversation"
+	"github.com/lenye/aichat/internal/provider"
+)
+
+const (
+	summaryMaxTokens = 512
+
+	summarySystem = "You condense conversations. Write a concise summary of the conversation below, " +
+		"preserving key facts, decisions, names, numbers, code identifiers and open questions. " +
+		"Write in the language of the conversation. Reply with the summary only."
+
+	// summaryPrefix 注入到系统提示语之后的摘要消息的开头
+	summaryPrefix = "Summary of the earlier conversation:\n"
+)
+
+// summaryMessage 摘要消息
+func summaryMessage(summary string) openai.ChatCompletionMessage {
+	return openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: summaryPrefix + summary,
+	}
+}
+
+// Summarize 用 model 把 previous 摘要和 msgs 聊天记录合并为新的摘要
+func Summarize(ctx context.Context,
+	p provider.Provider,
+	model, previous string,
+	msgs []openai.ChatCompletionMessage) (string, error) {
+	var sb strings.Builder
+	if previous != "" {
+		fmt.Fprintf(&sb, "Previous summary:\n%s\n\nConversation:\n", previous)
+	}
+	for _, msg := range msgs {
+		fmt.Fprintf(&sb, "%s: %s\n\n", msg.Role, msg.Content)
+	}
+
+	resp, err := p.CreateChat(ctx, &openai.ChatCompletionRequest{
+		Model:     model,
+		MaxTokens: summaryMaxTokens,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: summarySystem},
+			{Role: openai.ChatMessageRoleUser, Content: sb.String()},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.Content == "" {
+		return "", errors.New("empty summary")
+	}
+	return strings.TrimSpace(resp.Content), nil
+}
+
+// SummarizeConversation 未被摘要的聊天记录超过 threshold 条时，把较早的部分合并到会话摘要，
+// model 为空时使用会话的模型。返回 true 表示会话的摘要已更新，需要保存。
+func SummarizeConversation(ctx context.Context,
+	p provider.Provider,
+	model string,
+	threshold uint,
+	conv *conversation.Conversation) (bool, error) {
+	msgs, upto := conv.ToSummarize(threshold)
+	if len(msgs) == 0 {
+		return false, nil
+	}
+	if model == "" {
+		model = conv.Model
+	}
+	summary, err := Summarize(ctx, p, model, conv.Summary, msgs)
+	if err != nil {
+		return false, err
+	}
+	conv.Summary = summary
+	conv.Summarized = upto
+	return true, nil
+}
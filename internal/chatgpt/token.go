@@ -0,0 +1,194 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatgpt
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/tiktoken-go/tokenizer"
+)
+
+const (
+	// defaultContextWindow 未知模型的上下文长度
+	defaultContextWindow = 8192
+	// defaultReplyTokens MaxTokens=0 时为ai回复预留的tokens
+	defaultReplyTokens = 1024
+	// minTruncateTokens 截断最早的聊天记录时，至少保留的tokens，否则整条删除
+	minTruncateTokens = 64
+
+	// https://github.com/openai/openai-cookbook/blob/main/examples/How_to_count_tokens_with_tiktoken.ipynb
+	tokensPerMessage = 3 // 每条消息: <|start|>{role}\n{content}<|end|>\n
+	tokensPerReply   = 3 // 每个回复: <|start|>assistant<|message|>
+)
+
+// contextWindows 模型的上下文长度，按前缀匹配，长的前缀在前
+var contextWindows = []struct {
+	prefix string
+	tokens int
+}{
+	{"gpt-4o", 128000},
+	{"chatgpt-4o", 128000},
+	{"o1", 128000},
+	{"o3", 200000},
+	{"gpt-4-turbo", 128000},
+	{"gpt-4-1106", 128000},
+	{"gpt-4-0125", 128000},
+	{"gpt-4-vision", 128000},
+	{"gpt-4-32k", 32768},
+	{"gpt-4", 8192},
+	{"gpt-3.5-turbo-instruct", 4096},
+	{"gpt-3.5-turbo", 16385},
+	{"gpt-35-turbo-16k", 16384},
+	{"gpt-35-turbo", 4096},
+	{"gemini-1.5-pro", 2097152},
+	{"gemini-1.5-flash", 1048576},
+	{"gemini-2", 1048576},
+	{"gemini-1.0-pro", 32760},
+	{"claude-instant", 100000},
+	{"claude-2.0", 100000},
+	{"claude-", 200000},
+}
+
+// ContextWindow 模型的上下文长度
+func ContextWindow(model string) int {
+	model = strings.ToLower(model)
+	for _, v := range contextWindows {
+		if strings.HasPrefix(model, v.prefix) {
+			return v.tokens
+		}
+	}
+	return defaultContextWindow
+}
+
+var codecs sync.Map // tokenizer.Encoding -> tokenizer.Codec
+
+// codecForModel 模型的编码，未知模型使用 cl100k_base
+func codecForModel(model string) tokenizer.Codec {
+	enc := tokenizer.Cl100kBase
+	m := strings.ToLower(model)
+	if strings.HasPrefix(m, "gpt-4o") || strings.HasPrefix(m, "chatgpt-4o") ||
+		strings.HasPrefix(m, "o1") || strings.HasPrefix(m, "o3") {
+		enc = tokenizer.O200kBase
+	}
+	if v, ok := codecs.Load(enc); ok {
+		return v.(tokenizer.Codec)
+	}
+	codec, err := tokenizer.Get(enc)
+	if err != nil {
+		return nil
+	}
+	v, _ := codecs.LoadOrStore(enc, codec)
+	return v.(tokenizer.Codec)
+}
+
+// countTokens 文本的tokens，编码失败时按字符数估算
+func countTokens(codec tokenizer.Codec, text string) int {
+	if codec != nil {
+		if ids, _, err := codec.Encode(text); err == nil {
+			return len(ids)
+		}
+	}
+	return len([]rune(text))
+}
+
+// messageTokens 一条消息的tokens
+func messageTokens(codec tokenizer.Codec, msg openai.ChatCompletionMessage) int {
+	n := tokensPerMessage + countTokens(codec, msg.Role) + countTokens(codec, msg.Content)
+	if msg.Name != "" {
+		n += countTokens(codec, msg.Name) + 1
+	}
+	return n
+}
+
+// CountTokens 聊天消息的prompt tokens
+func CountTokens(model string, msgs []openai.ChatCompletionMessage) int {
+	codec := codecForModel(model)
+	n := tokensPerReply
+	for _, msg := range msgs {
+		n += messageTokens(codec, msg)
+	}
+	return n
+}
+
+// truncateHead 删除文本的开头部分，保留最后 tokens 个token
+func truncateHead(codec tokenizer.Codec, text string, tokens int) string {
+	if codec == nil {
+		r := []rune(text)
+		if len(r) <= tokens {
+			return text
+		}
+		return string(r[len(r)-tokens:])
+	}
+	ids, _, err := codec.Encode(text)
+	if err != nil || len(ids) <= tokens {
+		return text
+	}
+	s, err := codec.Decode(ids[len(ids)-tokens:])
+	if err != nil {
+		return text
+	}
+	return s
+}
+
+// Trimmed 为适应模型上下文长度被删除的聊天记录
+type Trimmed struct {
+	Messages  int // 删除的消息条数
+	Truncated int // 被截断的消息条数
+	Tokens    int // 删除的tokens
+}
+
+// Empty 没有删除任何聊天记录
+func (t Trimmed) Empty() bool {
+	return t.Messages == 0 && t.Truncated == 0
+}
+
+// fitHistory 从最早的聊天记录开始删除或截断，直到 budget 能容纳剩余的聊天记录
+func fitHistory(codec tokenizer.Codec, history []openai.ChatCompletionMessage, budget int) ([]openai.ChatCompletionMessage, Trimmed) {
+	var trimmed Trimmed
+
+	// 从最新的聊天记录开始，保留放得下的
+	used := 0
+	start := len(history)
+	for start > 0 {
+		n := messageTokens(codec, history[start-1])
+		if used+n > budget {
+			break
+		}
+		used += n
+		start--
+	}
+	if start == 0 {
+		return history, trimmed
+	}
+
+	kept := append([]openai.ChatCompletionMessage(nil), history[start:]...)
+	for _, msg := range history[:start] {
+		trimmed.Messages++
+		trimmed.Tokens += messageTokens(codec, msg)
+	}
+
+	// 剩余空间足够时，截断放不下的那条消息，保留它的结尾部分
+	oldest := history[start-1]
+	if room := budget - used - tokensPerMessage - countTokens(codec, oldest.Role); room >= minTruncateTokens {
+		oldest.Content = truncateHead(codec, oldest.Content, room)
+		kept = append([]openai.ChatCompletionMessage{oldest}, kept...)
+		trimmed.Messages--
+		trimmed.Truncated++
+		trimmed.Tokens -= messageTokens(codec, oldest)
+	}
+	return kept, trimmed
+}
@@ -0,0 +1,123 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatgpt
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/lenye/aichat/internal/billing"
+	"github.com/lenye/aichat/internal/provider"
+	"github.com/lenye/aichat/pkg/web/logging"
+	"github.com/lenye/aichat/pkg/web/ratelimit"
+)
+
+// CheckBalance 提问前检查用户的余额和额度，不足时返回显示给用户的提示
+func CheckBalance(ctx context.Context, user string) (string, error) {
+	err := billing.Check(user)
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.Is(err, billing.ErrInsufficientBalance):
+		return "[[余额不足，请联系管理员充值]]", err
+	case errors.Is(err, billing.ErrQuotaExceeded):
+		return "[[本月的 tokens 额度已用完]]", err
+	default:
+		logging.FromContext(ctx).Error("check balance failed",
+			"error", err,
+			"user", user,
+		)
+		return "[[计费服务不可用]]", err
+	}
+}
+
+// IncludeUsage 计费或者有每天 tokens 数的限流时，要求流模式在最后返回 tokens 用量: stream_options.include_usage
+func IncludeUsage(ctx context.Context, req *openai.ChatCompletionRequest) {
+	if req.Stream && req.StreamOptions == nil && (billing.Enabled() || ratelimit.Metered(ctx)) {
+		req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+}
+
+// RecordUsage 记录一次聊天的 tokens 用量: 计费，扣除限流的每天 tokens 额度。
+// 上游没有返回用量时用 tokenizer 估算。
+func RecordUsage(ctx context.Context, req *openai.ChatCompletionRequest, resp *provider.Response) {
+	billed, metered := billing.Enabled(), ratelimit.Metered(ctx)
+	if (!billed && !metered) || resp == nil {
+		return
+	}
+
+	usage, estimated := usageOf(req, resp.Usage, resp.Content)
+	if usage.PromptTokens == 0 && usage.CompletionTokens == 0 {
+		return
+	}
+	if estimated {
+		logging.FromContext(ctx).Debug("usage estimated by tokenizer",
+			"model", req.Model,
+		)
+	}
+
+	if metered {
+		ratelimit.Consume(ctx, usage.PromptTokens+usage.CompletionTokens)
+	}
+	if billed {
+		bill(ctx, req.User, servedModel(req, resp), usage)
+	}
+}
+
+// servedModel 实际使用的模型，换用备用后端时按备用的模型计费；提供方没有返回时为请求的模型
+func servedModel(req *openai.ChatCompletionRequest, resp *provider.Response) string {
+	if resp.Model != "" {
+		return resp.Model
+	}
+	return req.Model
+}
+
+// usageOf 上游返回的用量，没有返回用量并且有回复时用 tokenizer 估算，estimated=true
+func usageOf(req *openai.ChatCompletionRequest, usage openai.Usage, content string) (openai.Usage, bool) {
+	if usage.PromptTokens != 0 || usage.CompletionTokens != 0 || content == "" {
+		return usage, false
+	}
+	usage.PromptTokens = CountTokens(req.Model, req.Messages)
+	usage.CompletionTokens = countTokens(codecForModel(req.Model), content)
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage, true
+}
+
+// bill 按模型的价格记账
+func bill(ctx context.Context, user, model string, usage openai.Usage) {
+	logger := logging.FromContext(ctx)
+
+	e, a, err := billing.Charge(user, model, usage)
+	if err != nil {
+		logger.Error("bill usage failed",
+			"error", err,
+			"user", user,
+			"model", model,
+			"prompt_tokens", usage.PromptTokens,
+			"completion_tokens", usage.CompletionTokens,
+		)
+		return
+	}
+	logger.Info("usage billed",
+		"user", a.User,
+		"model", model,
+		"prompt_tokens", e.PromptTokens,
+		"completion_tokens", e.CompletionTokens,
+		"cost", billing.FormatAmount(-e.Amount),
+		"balance", billing.FormatAmount(a.Balance),
+	)
+}
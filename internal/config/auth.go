@@ -0,0 +1,63 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lenye/aichat/pkg/web/auth"
+)
+
+// AuthConfig web 登录认证配置，password、htpasswd、tokens 都为空时不需要登录
+type AuthConfig struct {
+	Password     string   `json:"password,omitempty"`      // 共享的静态密码
+	Htpasswd     string   `json:"htpasswd,omitempty"`      // htpasswd 文件，只支持 bcrypt
+	Tokens       []string `json:"tokens,omitempty"`        // api 的 bearer token: user:token
+	SessionKey   string   `json:"session_key,omitempty"`   // 会话 cookie 的签名密钥，为空时每次启动随机生成
+	SessionTTL   Duration `json:"session_ttl"`             // 会话有效期
+	SecureCookie bool     `json:"secure_cookie,omitempty"` // 会话 cookie 只在 https 下发送
+}
+
+// newAuth 按配置创建认证方式
+func newAuth(v *AuthConfig) (*auth.Auth, error) {
+	a := &auth.Auth{
+		Sessions: auth.NewSessions([]byte(v.SessionKey), time.Duration(v.SessionTTL), v.SecureCookie),
+	}
+	if v.Password != "" {
+		a.Authenticators = append(a.Authenticators, auth.SharedPassword(v.Password))
+	}
+	if v.Htpasswd != "" {
+		users, err := auth.LoadHtpasswd(v.Htpasswd)
+		if err != nil {
+			return nil, InvalidKey("auth.htpasswd", v.Htpasswd, err)
+		}
+		if _, ok := users[auth.GuestUser]; ok && v.Password != "" {
+			// 共享密码登录的用户为 guest，不能和 htpasswd 的用户重名
+			return nil, InvalidKey("auth.htpasswd", v.Htpasswd,
+				fmt.Errorf("user %q is reserved for auth.password", auth.GuestUser))
+		}
+		a.Authenticators = append(a.Authenticators, users)
+	}
+	if len(v.Tokens) > 0 {
+		tokens, err := auth.ParseTokens(v.Tokens)
+		if err != nil {
+			// 不在错误中显示 token
+			return nil, &KeyError{Key: "auth.tokens", Err: err}
+		}
+		a.Tokens = tokens
+	}
+	return a, nil
+}
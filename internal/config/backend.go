@@ -0,0 +1,201 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/lenye/aichat/internal/provider"
+)
+
+// DefaultBackend openai_* 参数配置的后端名称
+const DefaultBackend = "default"
+
+// BackendConfig 命名的后端配置
+type BackendConfig struct {
+	Name       string   `json:"name"`                   // 名称
+	ApiType    string   `json:"api_type,omitempty"`     // api类型
+	ApiKey     string   `json:"api_key,omitempty"`      // api key
+	ApiBaseUrl string   `json:"api_base_url,omitempty"` // base url
+	Proxy      string   `json:"proxy,omitempty"`        // 代理
+	Models     []string `json:"models,omitempty"`       // 模型名称或 glob 模式，为空时匹配所有模型
+	Fallback   []string `json:"fallback,omitempty"`     // 失败时依次使用的后端: 名称或者 名称:模型
+
+	OllamaKeepAlive string `json:"ollama_keep_alive,omitempty"` // ollama 模型在内存中保留的时间
+	OllamaNumCtx    uint   `json:"ollama_num_ctx,omitempty"`    // ollama 上下文长度
+}
+
+// Backends 后端列表，同时是命令行参数 --backend 的值，可以重复设置:
+//
+//	name=local,type=ollama,url=http://127.0.0.1:11434,models=llama3*|qwen2*
+//	name=azure,type=azure,key=xx,url=xx,models=gpt-4o,fallback=default|local:llama3:8b
+type Backends []*BackendConfig
+
+// Set 解析一个 --backend 参数
+func (v *Backends) Set(s string) error {
+	b := new(BackendConfig)
+	for _, field := range strings.Split(s, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("invalid backend field: %q, want key=value", field)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		switch key {
+		case "name":
+			b.Name = value
+		case "type":
+			b.ApiType = value
+		case "key":
+			b.ApiKey = value
+		case "url":
+			b.ApiBaseUrl = value
+		case "proxy":
+			b.Proxy = value
+		case "models":
+			for _, m := range strings.Split(value, "|") {
+				if m = strings.TrimSpace(m); m != "" {
+					b.Models = append(b.Models, m)
+				}
+			}
+		case "fallback":
+			for _, f := range strings.Split(value, "|") {
+				if f = strings.TrimSpace(f); f != "" {
+					b.Fallback = append(b.Fallback, f)
+				}
+			}
+		case "keep_alive":
+			b.OllamaKeepAlive = value
+		case "num_ctx":
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid backend num_ctx: %q", value)
+			}
+			b.OllamaNumCtx = uint(n)
+		default:
+			return fmt.Errorf("invalid backend field: %q", key)
+		}
+	}
+	*v = append(*v, b)
+	return nil
+}
+
+func (v *Backends) String() string {
+	names := make([]string, 0, len(*v))
+	for _, b := range *v {
+		names = append(names, b.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (v *Backends) Type() string {
+	return "backend"
+}
+
+func checkBackendConfig(v Backends, openai *OpenAIConfig) error {
+	names := make(map[string]struct{}, len(v))
+	for i, b := range v {
+		if b.Name == "" {
+			return missedKey(fmt.Sprintf("backends[%d].name", i))
+		}
+		if _, ok := names[b.Name]; ok || b.Name == DefaultBackend {
+			return InvalidKey(fmt.Sprintf("backends[%d].name", i), b.Name, errors.New("duplicate name"))
+		}
+		names[b.Name] = struct{}{}
+
+		if b.ApiType == "" {
+			b.ApiType = provider.APITypeOpenAI
+		} else if !provider.ValidAPIType(b.ApiType) {
+			return InvalidKey(fmt.Sprintf("backends[%d].api_type", i), b.ApiType, nil)
+		}
+		if b.ApiKey == "" && provider.RequiresAPIKey(b.ApiType) {
+			return missedKey(fmt.Sprintf("backends[%d].api_key", i))
+		}
+		if b.ApiBaseUrl != "" {
+			if _, err := url.Parse(b.ApiBaseUrl); err != nil {
+				return InvalidKey(fmt.Sprintf("backends[%d].api_base_url", i), b.ApiBaseUrl, err)
+			}
+		}
+		if b.Proxy != "" {
+			if _, err := url.Parse(b.Proxy); err != nil {
+				return InvalidKey(fmt.Sprintf("backends[%d].proxy", i), b.Proxy, err)
+			}
+		}
+		for _, m := range b.Models {
+			if _, err := path.Match(m, ""); err != nil {
+				return InvalidKey(fmt.Sprintf("backends[%d].models", i), m, err)
+			}
+		}
+	}
+	// 备用后端可以是配置的后端，以及存在时的 default
+	hasDefault := hasDefaultBackend(openai, v)
+	for i, b := range v {
+		for _, f := range b.Fallback {
+			name := provider.ParseFallback(f).Backend
+			if _, ok := names[name]; !ok && (name != DefaultBackend || !hasDefault) {
+				return InvalidKey(fmt.Sprintf("backends[%d].fallback", i), f, errors.New("unknown backend"))
+			}
+			if name == b.Name {
+				return InvalidKey(fmt.Sprintf("backends[%d].fallback", i), f, errors.New("falls back to itself"))
+			}
+		}
+	}
+	return nil
+}
+
+// AllBackends 全部后端，openai_* 参数配置的后端名称为 default，匹配所有模型，排在最后。
+// 配置了其它后端并且没有设置 openai_api_key 时，没有 default 后端。
+func (p *Configuration) AllBackends() []*BackendConfig {
+	all := make([]*BackendConfig, 0, len(p.Backends)+1)
+	all = append(all, p.Backends...)
+	v := p.OpenAI
+	if hasDefaultBackend(v, p.Backends) {
+		all = append(all, &BackendConfig{
+			Name:            DefaultBackend,
+			ApiType:         v.ApiType,
+			ApiKey:          v.ApiKey,
+			ApiBaseUrl:      v.ApiBaseUrl,
+			Proxy:           v.Proxy,
+			OllamaKeepAlive: v.OllamaKeepAlive,
+			OllamaNumCtx:    v.OllamaNumCtx,
+		})
+	}
+	return all
+}
+
+// hasDefaultBackend 是否有 openai_* 参数配置的 default 后端
+func hasDefaultBackend(v *OpenAIConfig, backends Backends) bool {
+	return v.ApiKey != "" || !provider.RequiresAPIKey(v.ApiType) || len(backends) == 0
+}
+
+// FailoverConfig 后端失败时的熔断配置
+type FailoverConfig struct {
+	Threshold uint     `json:"threshold"` // 连续失败次数达到后熔断，0=不熔断
+	Cooldown  Duration `json:"cooldown"`  // 熔断的时间
+}
+
+// RetryConfig 临时错误的重试配置
+type RetryConfig struct {
+	MaxAttempts uint     `json:"max_attempts"` // 每个后端最多尝试的次数，包括第一次，<=1 时不重试
+	Deadline    Duration `json:"deadline"`     // 从第一次请求开始，超过该时间不再重试，0=不限制
+}
@@ -0,0 +1,138 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/lenye/aichat/internal/billing"
+)
+
+// BillingConfig tokens 用量的计费配置
+type BillingConfig struct {
+	Enabled        bool    `json:"enabled"`                   // 记录用量，余额或者额度不足时拒绝提问
+	Prices         Prices  `json:"prices,omitempty"`          // 模型的价格
+	InitialBalance float64 `json:"initial_balance,omitempty"` // 新用户的初始余额
+	TokenQuota     uint64  `json:"token_quota,omitempty"`     // 每个用户每月的 tokens 额度，0=不限制
+}
+
+// PriceConfig 模型的价格，每 1M tokens 的金额
+type PriceConfig struct {
+	Model  string  `json:"model"`  // 模型名称，支持通配符，如 gpt-4o*
+	Input  float64 `json:"input"`  // 提示语
+	Output float64 `json:"output"` // 回复
+}
+
+func (p *PriceConfig) String() string {
+	return fmt.Sprintf("%s=%g/%g", p.Model, p.Input, p.Output)
+}
+
+// Prices 价格表，同时是命令行参数 --billing_price 的值，可以重复设置:
+//
+//	gpt-4o=2.5/10
+//	claude-3-5-sonnet*=3/15
+type Prices []*PriceConfig
+
+// Set 解析一个 --billing_price 参数
+func (v *Prices) Set(s string) error {
+	model, prices, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("invalid price: %q, want model=input/output", s)
+	}
+	input, output, ok := strings.Cut(prices, "/")
+	if !ok {
+		return fmt.Errorf("invalid price: %q, want model=input/output", s)
+	}
+	p := &PriceConfig{Model: strings.TrimSpace(model)}
+	var err error
+	if p.Input, err = strconv.ParseFloat(strings.TrimSpace(input), 64); err != nil {
+		return fmt.Errorf("invalid input price: %q", input)
+	}
+	if p.Output, err = strconv.ParseFloat(strings.TrimSpace(output), 64); err != nil {
+		return fmt.Errorf("invalid output price: %q", output)
+	}
+	*v = append(*v, p)
+	return nil
+}
+
+func (v *Prices) String() string {
+	return strings.Join(v.GetSlice(), ",")
+}
+
+func (v *Prices) Type() string {
+	return "price"
+}
+
+// Append pflag.SliceValue
+func (v *Prices) Append(s string) error {
+	return v.Set(s)
+}
+
+// Replace pflag.SliceValue
+func (v *Prices) Replace(list []string) error {
+	var prices Prices
+	for _, s := range list {
+		if err := prices.Set(s); err != nil {
+			return err
+		}
+	}
+	*v = prices
+	return nil
+}
+
+// GetSlice pflag.SliceValue
+func (v *Prices) GetSlice() []string {
+	list := make([]string, 0, len(*v))
+	for _, p := range *v {
+		list = append(list, p.String())
+	}
+	return list
+}
+
+// newBillingPolicy 检查计费配置，创建计费策略
+func newBillingPolicy(v *BillingConfig) (*billing.Policy, error) {
+	p := &billing.Policy{
+		Enabled:    v.Enabled,
+		TokenQuota: int64(v.TokenQuota),
+	}
+	if v.InitialBalance < 0 || math.IsNaN(v.InitialBalance) || math.IsInf(v.InitialBalance, 0) {
+		return nil, InvalidKey("billing.initial_balance", v.InitialBalance, nil)
+	}
+	p.InitialBalance = int64(math.Round(v.InitialBalance * billing.Micro))
+
+	for i, price := range v.Prices {
+		key := fmt.Sprintf("billing.prices[%d]", i)
+		if price.Model == "" {
+			return nil, missedKey(key + ".model")
+		}
+		if _, err := path.Match(price.Model, ""); err != nil {
+			return nil, InvalidKey(key+".model", price.Model, err)
+		}
+		if price.Input < 0 || price.Output < 0 {
+			return nil, InvalidKey(key, fmt.Sprintf("%g/%g", price.Input, price.Output), errors.New("negative price"))
+		}
+		p.Prices = append(p.Prices, billing.Price{
+			Model:  price.Model,
+			Input:  price.Input,
+			Output: price.Output,
+		})
+	}
+	return p, nil
+}
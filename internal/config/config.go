@@ -23,10 +23,14 @@ import (
 	"path/filepath"
 	"strings"
 	"sync/atomic"
+	"time"
 
-	"github.com/sashabaranov/go-openai"
-
+	"github.com/lenye/aichat/internal/billing"
+	"github.com/lenye/aichat/internal/provider"
 	"github.com/lenye/aichat/pkg/project"
+	"github.com/lenye/aichat/pkg/web/auth"
+	"github.com/lenye/aichat/pkg/web/certs"
+	"github.com/lenye/aichat/pkg/web/ratelimit"
 )
 
 var defaultConfig atomic.Value
@@ -56,8 +60,34 @@ func New(appDirIn string) *Configuration {
 			Level:  "info",
 			Format: "text",
 		},
-		Web:    new(WebServerConfig),
+		Web: &WebServerConfig{
+			DrainTimeout: Duration(30 * time.Second),
+			TLS: &WebTLSConfig{
+				MinVersion: "1.2",
+				ClientAuth: certs.ClientAuthRequire,
+			},
+		},
 		OpenAI: new(OpenAIConfig),
+		Store: &StoreConfig{
+			Type: "file",
+		},
+		Failover: &FailoverConfig{
+			Threshold: 3,
+			Cooldown:  Duration(30 * time.Second),
+		},
+		Retry: &RetryConfig{
+			MaxAttempts: 3,
+			Deadline:    Duration(time.Minute),
+		},
+		Gateway: new(GatewayConfig),
+		Auth: &AuthConfig{
+			SessionTTL: Duration(auth.DefaultSessionTTL),
+		},
+		Billing:   new(BillingConfig),
+		RateLimit: new(RateLimitConfig),
+		Tracing: &TracingConfig{
+			SampleRatio: 1,
+		},
 	}
 	if appDirIn == "" {
 		v.App.Dir = filepath.Dir(v.App.Path)
@@ -74,13 +104,24 @@ type Configuration struct {
 	Log    *LogConfig       `json:"log"`    // 日志
 	Web    *WebServerConfig `json:"web"`    // web server
 	OpenAI *OpenAIConfig    `json:"openai"` // openai
+	Store  *StoreConfig     `json:"store"`  // 会话存储
+
+	Backends Backends        `json:"backends,omitempty"` // 命名的后端，按模型选择
+	Failover *FailoverConfig `json:"failover"`           // 熔断
+	Retry    *RetryConfig    `json:"retry"`              // 重试
+
+	Gateway   *GatewayConfig   `json:"gateway"`    // 兼容 openai api 的网关
+	Auth      *AuthConfig      `json:"auth"`       // web 登录认证
+	Billing   *BillingConfig   `json:"billing"`    // tokens 用量的计费
+	RateLimit *RateLimitConfig `json:"rate_limit"` // web 聊天的限流
+	Tracing   *TracingConfig   `json:"tracing"`    // 链路追踪
 }
 
 // Print 打印配置
 func (p *Configuration) Print() {
 	slog.Debug("configuration",
 		slog.Group("config",
-			"app", p.App, "log", p.Log, "web", p.Web, "openai", p.OpenAI,
+			"app", p.App, "log", p.Log, "web", p.Web, "openai", p.OpenAI, "store", p.Store, "backends", p.Backends, "failover", p.Failover, "retry", p.Retry, "gateway", p.Gateway, "auth", p.Auth, "billing", p.Billing, "rate_limit", p.RateLimit, "tracing", p.Tracing,
 		),
 	)
 }
@@ -93,14 +134,20 @@ type AppConfig struct {
 
 // LogConfig 日志配置
 type LogConfig struct {
-	Caller bool   `yaml:"caller,omitempty"` // true=打印代码名称和行号
-	Level  string `yaml:"level,omitempty"`  // 输出日志level
-	Format string `yaml:"format,omitempty"` // 日志输出格式 text, json
+	Caller bool   `json:"caller,omitempty" yaml:"caller,omitempty"` // true=打印代码名称和行号
+	Level  string `json:"level,omitempty" yaml:"level,omitempty"`   // 输出日志level
+	Format string `json:"format,omitempty" yaml:"format,omitempty"` // 日志输出格式 text, json
 }
 
 // WebServerConfig web server配置
 type WebServerConfig struct {
-	Port uint `json:"port"` // 服务端口
+	Port           uint          `json:"port"`                       // 服务端口，没有设置 listen 时监听 :port
+	Listen         []string      `json:"listen,omitempty"`           // 监听地址: 127.0.0.1:8080, unix:/run/aichat.sock, systemd, systemd:name
+	UnixSocketMode string        `json:"unix_socket_mode,omitempty"` // unix socket 的文件权限，如 0660
+	Metrics        bool          `json:"metrics"`                    // 提供 prometheus 指标 /metrics
+	ReadyProbe     bool          `json:"ready_probe"`                // 就绪检查 /readyz 同时检查上游
+	DrainTimeout   Duration      `json:"drain_timeout"`              // SIGTERM 后等待进行中的聊天结束的期限
+	TLS            *WebTLSConfig `json:"tls"`                        // https
 }
 
 // OpenAIConfig chatGPT配置
@@ -115,6 +162,19 @@ type OpenAIConfig struct {
 	Stream     bool   `json:"stream"`                 // 流模式
 	MaxTokens  uint   `json:"max_tokens"`             // 最大tokens
 	History    uint   `json:"history"`                // 历史记录
+
+	ContextWindow    uint   `json:"context_window,omitempty"`    // 模型上下文长度，0=按模型自动识别
+	SummaryThreshold uint   `json:"summary_threshold,omitempty"` // 未被摘要的聊天记录超过该条数时生成摘要，0=不摘要
+	SummaryModel     string `json:"summary_model,omitempty"`     // 生成摘要的模型，默认为聊天的模型
+
+	OllamaKeepAlive string `json:"ollama_keep_alive,omitempty"` // ollama 模型在内存中保留的时间
+	OllamaNumCtx    uint   `json:"ollama_num_ctx,omitempty"`    // ollama 上下文长度
+}
+
+// StoreConfig 会话存储配置
+type StoreConfig struct {
+	Type string `json:"type"`          // 存储类型 file, bolt
+	Dir  string `json:"dir,omitempty"` // 存储目录，默认为程序运行目录
 }
 
 func setupLog(v *LogConfig) {
@@ -167,43 +227,134 @@ func setupLog(v *LogConfig) {
 	slog.SetDefault(logger)
 }
 
-func checkOpenAIConfig(v *OpenAIConfig) error {
+// checkOpenAIConfig 配置了其它后端时，可以不设置 openai_api_key
+func checkOpenAIConfig(v *OpenAIConfig, backends Backends) error {
 	// chat
 	if v.ApiType == "" {
-		v.ApiType = string(openai.APITypeOpenAI)
-	} else {
-		apiType := openai.APIType(strings.ToUpper(v.ApiType))
-		switch apiType {
-		case openai.APITypeOpenAI, openai.APITypeAzure, openai.APITypeAzureAD:
-		default:
-			return fmt.Errorf("invalid openai_api_type: %q", v.ApiType)
-		}
+		v.ApiType = provider.APITypeOpenAI
+	} else if !provider.ValidAPIType(v.ApiType) {
+		return InvalidKey("openai.api_type", v.ApiType, nil)
+	}
+
+	if v.ApiKey == "" && provider.RequiresAPIKey(v.ApiType) && len(backends) == 0 {
+		return missedKey("openai.api_key")
+	}
+
+	// ollama 的上下文长度就是模型的上下文长度
+	if v.ContextWindow == 0 && strings.EqualFold(v.ApiType, provider.APITypeOllama) {
+		v.ContextWindow = v.OllamaNumCtx
 	}
 
 	if v.ApiBaseUrl != "" {
 		if _, err := url.Parse(v.ApiBaseUrl); err != nil {
-			return fmt.Errorf("invalid openai_api_base_url: %q, cause: %w", v.ApiBaseUrl, err)
+			return InvalidKey("openai.api_base_url", v.ApiBaseUrl, err)
 		}
 	}
 
 	if v.Proxy != "" {
 		if _, err := url.Parse(v.Proxy); err != nil {
-			return fmt.Errorf("invalid openai_proxy: %q, cause: %w", v.Proxy, err)
+			return InvalidKey("openai.proxy", v.Proxy, err)
 		}
 	}
 	return nil
 }
 
+func checkStoreConfig(v *StoreConfig, app *AppConfig) error {
+	v.Type = strings.ToLower(v.Type)
+	switch v.Type {
+	case "file", "bolt":
+	default:
+		return InvalidKey("store.type", v.Type, nil)
+	}
+	if v.Dir == "" {
+		v.Dir = app.Dir
+	}
+	return nil
+}
+
+// SetupStore 只校验会话存储的配置，用于不访问上游的子命令，如 sessions
+func SetupStore(v *Configuration) error {
+	setupLog(v.Log)
+	return checkStoreConfig(v.Store, v.App)
+}
+
+// SetupBilling 只校验会话存储和计费的配置，设置默认的计费策略，用于 billing 子命令
+func SetupBilling(v *Configuration) error {
+	if err := SetupStore(v); err != nil {
+		return err
+	}
+	policy, err := newBillingPolicy(v.Billing)
+	if err != nil {
+		return err
+	}
+	billing.SetDefault(policy)
+	return nil
+}
+
 func Setup(v *Configuration) error {
 	// log
 	setupLog(v.Log)
 
 	// openai
-	if err := checkOpenAIConfig(v.OpenAI); err != nil {
+	if err := checkOpenAIConfig(v.OpenAI, v.Backends); err != nil {
+		return err
+	}
+
+	// backends
+	if err := checkBackendConfig(v.Backends, v.OpenAI); err != nil {
+		return err
+	}
+
+	// store
+	if err := checkStoreConfig(v.Store, v.App); err != nil {
+		return err
+	}
+
+	// web listen
+	if err := checkWebListen(v.Web); err != nil {
+		return err
+	}
+
+	// https
+	if v.Web.TLS == nil {
+		v.Web.TLS = new(WebTLSConfig)
+	}
+	if err := checkWebTLSConfig(v.Web.TLS); err != nil {
+		return err
+	}
+
+	// auth
+	a, err := newAuth(v.Auth)
+	if err != nil {
+		return err
+	}
+
+	// billing
+	policy, err := newBillingPolicy(v.Billing)
+	if err != nil {
+		return err
+	}
+
+	// rate limit
+	groups, rules, err := newRateLimit(v.RateLimit)
+	if err != nil {
+		return err
+	}
+
+	// tracing
+	if err := checkTracingConfig(v.Tracing); err != nil {
+		return err
+	}
+
+	// gateway
+	if err := checkGatewayConfig(v.Gateway); err != nil {
 		return err
 	}
 
 	SetDefault(v)
+	auth.SetDefault(a)
+	billing.SetDefault(policy)
+	ratelimit.Default().Configure(groups, rules)
 
 	return nil
 }
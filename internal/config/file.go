@@ -0,0 +1,203 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// FileName 默认的配置文件名称，在程序运行目录中按扩展名的顺序查找
+const FileName = "aichat"
+
+// fileExts 支持的配置文件格式
+var fileExts = []string{".yaml", ".yml", ".json", ".toml"}
+
+// KeyError 配置项的错误，Key 是配置文件中的路径，例如 openai.api_type, backends[0].api_key
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("config %s: %s", e.Key, e.Err)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// InvalidKey 配置项的值无效
+func InvalidKey(key string, value any, cause error) *KeyError {
+	if cause == nil {
+		return &KeyError{Key: key, Err: fmt.Errorf("invalid value: %q", fmt.Sprint(value))}
+	}
+	return &KeyError{Key: key, Err: fmt.Errorf("invalid value: %q, cause: %w", fmt.Sprint(value), cause)}
+}
+
+// missedKey 缺少配置项
+func missedKey(key string) *KeyError {
+	return &KeyError{Key: key, Err: errors.New("missed")}
+}
+
+// Duration 配置文件中可以是 30s, 1m 这样的字符串，也可以是纳秒数
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return errors.New("want a duration like 30s")
+		}
+		*d = Duration(n)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// FindFile 在 dir 中查找默认的配置文件，没有时返回空字符串
+func FindFile(dir string) string {
+	for _, ext := range fileExts {
+		name := filepath.Join(dir, FileName+ext)
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// LoadFile 读取配置文件到 v，只覆盖文件中出现的配置项。
+// 按扩展名识别格式: yaml, yml, json, toml，配置项的名称与 json 标签一致。
+func LoadFile(v *Configuration, name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("read config file failed, cause: %w", err)
+	}
+
+	var m map[string]any
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &m)
+	case ".json":
+		err = json.Unmarshal(data, &m)
+	case ".toml":
+		err = toml.Unmarshal(data, &m)
+	default:
+		return fmt.Errorf("invalid config file: %q, unsupported format: %q", name, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("parse config file %q failed, cause: %w", name, err)
+	}
+
+	if err := checkKeys(m, reflect.TypeOf(v).Elem(), ""); err != nil {
+		return err
+	}
+
+	// 统一转换为 json 再按 json 标签解码
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("parse config file %q failed, cause: %w", name, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if err := dec.Decode(v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return &KeyError{Key: typeErr.Field, Err: fmt.Errorf("want %s, got %s", typeErr.Type, typeErr.Value)}
+		}
+		return fmt.Errorf("parse config file %q failed, cause: %w", name, err)
+	}
+	return nil
+}
+
+// checkKeys 检查配置文件中是否有未知的配置项
+func checkKeys(m map[string]any, t reflect.Type, prefix string) error {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+
+	for key, value := range m {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		ft, ok := fields[key]
+		if !ok {
+			return &KeyError{Key: path, Err: errors.New("unknown key")}
+		}
+		if err := checkValueKeys(value, ft, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkValueKeys(value any, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		if t.Kind() == reflect.Struct {
+			return checkKeys(v, t, path)
+		}
+	case []map[string]any:
+		// toml 的表格数组
+		if t.Kind() == reflect.Slice {
+			for i, item := range v {
+				if err := checkValueKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case []any:
+		if t.Kind() == reflect.Slice {
+			for i, item := range v {
+				if err := checkValueKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// GatewayUser 没有指定用户的网关 key 的用户，用于计费和额度
+const GatewayUser = "gateway"
+
+// GatewayConfig 兼容 openai api 的网关配置
+type GatewayConfig struct {
+	// 网关签发给客户端的 key: user:key 或者 key，没有用户时为 GatewayUser；为空时不开放网关
+	Keys []string `json:"keys,omitempty"`
+
+	users map[string]string // key -> user
+}
+
+// User 常量时间比较全部 key，返回 key 对应的用户，避免泄露 key 的内容
+func (v *GatewayConfig) User(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	var found string
+	for k, user := range v.users {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			found = user
+		}
+	}
+	return found, found != ""
+}
+
+func checkGatewayConfig(v *GatewayConfig) error {
+	v.users = make(map[string]string, len(v.Keys))
+	for i, s := range v.Keys {
+		user, key, ok := strings.Cut(s, ":")
+		if !ok {
+			user, key = GatewayUser, s
+		}
+		user, key = strings.TrimSpace(user), strings.TrimSpace(key)
+		// 不在错误中显示 key
+		if user == "" || key == "" {
+			return &KeyError{Key: fmt.Sprintf("gateway.keys[%d]", i), Err: errors.New("invalid key, want user:key or key")}
+		}
+		if _, ok := v.users[key]; ok {
+			return &KeyError{Key: fmt.Sprintf("gateway.keys[%d]", i), Err: fmt.Errorf("duplicate key of user %q", user)}
+		}
+		v.users[key] = user
+	}
+	return nil
+}
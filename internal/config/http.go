@@ -17,43 +17,95 @@ package config
 import (
 	"context"
 	"errors"
-	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"sync"
 	"time"
+
+	"github.com/lenye/aichat/pkg/web/certs"
 )
 
+// tlsReloadInterval 检查证书文件变化的间隔
+const tlsReloadInterval = 10 * time.Second
+
 func WebListenAndServe(handler http.Handler,
 	cfg *WebServerConfig,
 	wg *sync.WaitGroup,
 	logger *slog.Logger) (*http.Server, error) {
 
-	address := fmt.Sprintf(":%d", cfg.Port)
+	svr := &http.Server{
+		Handler: handler,
+	}
+
+	// https
+	var reloader *certs.Reloader
+	if cfg.TLS.Enabled() {
+		var err error
+		reloader, err = certs.NewReloader(cfg.TLS.Certs())
+		if err != nil {
+			logger.Error("load tls certificate failed",
+				"error", err,
+			)
+			return nil, err
+		}
+		svr.TLSConfig, err = reloader.TLSConfig()
+		if err != nil {
+			logger.Error("tls config failed",
+				"error", err,
+			)
+			return nil, err
+		}
+	}
+
 	// http server
-	ln, err := net.Listen("tcp", address)
+	listeners, err := webListeners(cfg)
 	if err != nil {
 		logger.Error("start web server failed",
 			"error", err,
 		)
 		return nil, err
 	}
-	logger.Info("web server listening on " + ln.Addr().String())
 
-	svr := &http.Server{
-		Handler: handler,
-	}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := svr.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			logger.Error("web serve failed",
-				"error", err,
+	for _, ln := range listeners {
+		if reloader == nil {
+			logger.Info("web server listening on " + listenerAddr(ln))
+		} else {
+			logger.Info("web server listening on "+listenerAddr(ln)+" (https)",
+				"min_version", cfg.TLS.MinVersion,
+				"client_auth", cfg.TLS.ClientCA != "",
 			)
 		}
-		logger.Info("web server stopped")
-	}()
+	}
+	if reloader != nil {
+		// 证书文件变化时重新加载，停止服务时结束
+		ctx, cancel := context.WithCancel(context.Background())
+		svr.RegisterOnShutdown(cancel)
+		go reloader.Watch(ctx, tlsReloadInterval, logger)
+	}
+
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			var err error
+			if reloader == nil {
+				err = svr.Serve(ln)
+			} else {
+				// 证书由 TLSConfig.GetCertificate 提供
+				err = svr.ServeTLS(ln, "", "")
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("web serve failed",
+					"error", err,
+					"listen", listenerAddr(ln),
+				)
+			}
+			logger.Info("web server stopped",
+				"listen", listenerAddr(ln),
+			)
+		}(ln)
+	}
 
 	return svr, nil
 }
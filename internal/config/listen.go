@@ -0,0 +1,179 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lenye/aichat/pkg/systemd"
+)
+
+// 监听地址的前缀
+const (
+	listenUnix    = "unix:"   // unix socket，如 unix:/run/aichat/aichat.sock
+	listenSystemd = "systemd" // systemd socket activation 传入的监听，systemd:name 只使用 FileDescriptorName=name 的监听
+)
+
+func checkWebListen(v *WebServerConfig) error {
+	for i, addr := range v.Listen {
+		key := fmt.Sprintf("web.listen[%d]", i)
+		switch {
+		case addr == listenSystemd || strings.HasPrefix(addr, listenSystemd+":"):
+		case strings.HasPrefix(addr, listenUnix):
+			if strings.TrimPrefix(addr, listenUnix) == "" {
+				return InvalidKey(key, addr, errors.New("missed socket path"))
+			}
+		default:
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return InvalidKey(key, addr, err)
+			}
+		}
+	}
+	if v.UnixSocketMode != "" {
+		if _, err := parseFileMode(v.UnixSocketMode); err != nil {
+			return InvalidKey("web.unix_socket_mode", v.UnixSocketMode, err)
+		}
+	}
+	return nil
+}
+
+// parseFileMode 八进制的文件权限，如 0660
+func parseFileMode(s string) (fs.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, errors.New("want octal file mode, e.g. 0660")
+	}
+	if n > 0o777 {
+		return 0, errors.New("file mode out of range")
+	}
+	return fs.FileMode(n), nil
+}
+
+// webListeners 按配置创建监听。
+// 没有设置 listen 时，有 systemd 传入的监听就使用它们，否则监听 :port
+func webListeners(cfg *WebServerConfig) ([]net.Listener, error) {
+	inherited, err := systemd.Listeners()
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := cfg.Listen
+	if len(addrs) == 0 {
+		if len(inherited) > 0 {
+			addrs = []string{listenSystemd}
+		} else {
+			addrs = []string{fmt.Sprintf(":%d", cfg.Port)}
+		}
+	}
+
+	used := make([]bool, len(inherited))
+	var list []net.Listener
+	for _, addr := range addrs {
+		lns, err := listen(addr, cfg, inherited, used)
+		if err != nil {
+			for _, ln := range list {
+				_ = ln.Close()
+			}
+			list = nil
+			break
+		}
+		list = append(list, lns...)
+	}
+	// 没有使用的 systemd 监听
+	for i, ln := range inherited {
+		if !used[i] {
+			_ = ln.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func listen(addr string, cfg *WebServerConfig, inherited []*systemd.Listener, used []bool) ([]net.Listener, error) {
+	switch {
+	case addr == listenSystemd || strings.HasPrefix(addr, listenSystemd+":"):
+		name, _ := strings.CutPrefix(addr, listenSystemd)
+		name = strings.TrimPrefix(name, ":")
+		var list []net.Listener
+		for i, ln := range inherited {
+			if !used[i] && (name == "" || ln.Name == name) {
+				used[i] = true
+				list = append(list, ln)
+			}
+		}
+		if len(list) == 0 {
+			if name == "" {
+				return nil, systemd.ErrNoListeners
+			}
+			return nil, fmt.Errorf("no systemd listener named %q", name)
+		}
+		return list, nil
+	case strings.HasPrefix(addr, listenUnix):
+		ln, err := listenUnixSocket(strings.TrimPrefix(addr, listenUnix), cfg.UnixSocketMode)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	default:
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+}
+
+// listenUnixSocket 监听 unix socket，删除上次没有正常退出时残留的 socket 文件
+func listenUnixSocket(path, mode string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("unix socket %q is in use", path)
+		}
+		_ = os.Remove(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" {
+		m, err := parseFileMode(mode)
+		if err == nil {
+			err = os.Chmod(path, m)
+		}
+		if err != nil {
+			_ = ln.Close()
+			return nil, fmt.Errorf("chmod unix socket failed, cause: %w", err)
+		}
+	}
+	return ln, nil
+}
+
+// listenerAddr 日志中的监听地址，unix socket 带有 unix: 前缀
+func listenerAddr(ln net.Listener) string {
+	if ln.Addr().Network() == "unix" {
+		return listenUnix + ln.Addr().String()
+	}
+	return ln.Addr().String()
+}
@@ -0,0 +1,232 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lenye/aichat/pkg/web/ratelimit"
+)
+
+// RateLimitConfig web 聊天的限流配置，没有规则时不限流
+type RateLimitConfig struct {
+	Groups RateLimitGroups `json:"groups,omitempty"` // 用户组，没有加入用户组的用户和未登录的客户端属于 default 组
+	Rules  RateLimitRules  `json:"rules,omitempty"`  // 规则
+}
+
+// RateLimitGroupConfig 用户组
+type RateLimitGroupConfig struct {
+	Name  string   `json:"name"`
+	Users []string `json:"users"`
+}
+
+func (g *RateLimitGroupConfig) String() string {
+	return g.Name + "=" + strings.Join(g.Users, "|")
+}
+
+// RateLimitRuleConfig 一个用户组在一个路由上的限制，为 0 的项不限制
+type RateLimitRuleConfig struct {
+	Group    string `json:"group,omitempty"`               // 用户组，空为 default
+	Route    string `json:"route,omitempty"`               // 路由，如 /chat/msg；空为全部限流的路由共用一份额度
+	Requests uint64 `json:"requests_per_minute,omitempty"` // 每分钟的请求数
+	Tokens   uint64 `json:"tokens_per_day,omitempty"`      // 每天的 tokens 数
+	Streams  uint64 `json:"streams,omitempty"`             // 并发数
+}
+
+func (v *RateLimitRuleConfig) String() string {
+	return fmt.Sprintf("group=%s,route=%s,requests=%d,tokens=%d,streams=%d", v.Group, v.Route, v.Requests, v.Tokens, v.Streams)
+}
+
+// RateLimitGroups 用户组列表，同时是命令行参数 --rate_limit_group 的值，可以重复设置:
+//
+//	vip=alice|bob
+type RateLimitGroups []*RateLimitGroupConfig
+
+// Set 解析一个 --rate_limit_group 参数
+func (v *RateLimitGroups) Set(s string) error {
+	name, users, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("invalid rate limit group: %q, want name=user1|user2", s)
+	}
+	g := &RateLimitGroupConfig{Name: strings.TrimSpace(name)}
+	for _, u := range strings.Split(users, "|") {
+		if u = strings.TrimSpace(u); u != "" {
+			g.Users = append(g.Users, u)
+		}
+	}
+	*v = append(*v, g)
+	return nil
+}
+
+func (v *RateLimitGroups) String() string {
+	return strings.Join(v.GetSlice(), ",")
+}
+
+func (v *RateLimitGroups) Type() string {
+	return "group"
+}
+
+// Append pflag.SliceValue
+func (v *RateLimitGroups) Append(s string) error {
+	return v.Set(s)
+}
+
+// Replace pflag.SliceValue
+func (v *RateLimitGroups) Replace(list []string) error {
+	var groups RateLimitGroups
+	for _, s := range list {
+		if err := groups.Set(s); err != nil {
+			return err
+		}
+	}
+	*v = groups
+	return nil
+}
+
+// GetSlice pflag.SliceValue
+func (v *RateLimitGroups) GetSlice() []string {
+	list := make([]string, 0, len(*v))
+	for _, g := range *v {
+		list = append(list, g.String())
+	}
+	return list
+}
+
+// RateLimitRules 规则列表，同时是命令行参数 --rate_limit 的值，可以重复设置:
+//
+//	route=/chat/sse/msg,requests=10,streams=1
+//	group=vip,tokens=1000000
+type RateLimitRules []*RateLimitRuleConfig
+
+// Set 解析一个 --rate_limit 参数
+func (v *RateLimitRules) Set(s string) error {
+	rule := new(RateLimitRuleConfig)
+	for _, field := range strings.Split(s, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("invalid rate limit field: %q, want key=value", field)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		switch key {
+		case "group":
+			rule.Group = value
+		case "route":
+			rule.Route = value
+		case "requests", "tokens", "streams":
+			n, err := strconv.ParseUint(value, 10, 63)
+			if err != nil {
+				return fmt.Errorf("invalid rate limit %s: %q", key, value)
+			}
+			switch key {
+			case "requests":
+				rule.Requests = n
+			case "tokens":
+				rule.Tokens = n
+			default:
+				rule.Streams = n
+			}
+		default:
+			return fmt.Errorf("invalid rate limit field: %q", key)
+		}
+	}
+	*v = append(*v, rule)
+	return nil
+}
+
+func (v *RateLimitRules) String() string {
+	return strings.Join(v.GetSlice(), ";")
+}
+
+func (v *RateLimitRules) Type() string {
+	return "rule"
+}
+
+// Append pflag.SliceValue
+func (v *RateLimitRules) Append(s string) error {
+	return v.Set(s)
+}
+
+// Replace pflag.SliceValue
+func (v *RateLimitRules) Replace(list []string) error {
+	var rules RateLimitRules
+	for _, s := range list {
+		if err := rules.Set(s); err != nil {
+			return err
+		}
+	}
+	*v = rules
+	return nil
+}
+
+// GetSlice pflag.SliceValue
+func (v *RateLimitRules) GetSlice() []string {
+	list := make([]string, 0, len(*v))
+	for _, r := range *v {
+		list = append(list, r.String())
+	}
+	return list
+}
+
+// newRateLimit 检查限流配置，返回用户组和规则
+func newRateLimit(v *RateLimitConfig) ([]ratelimit.Group, []ratelimit.Rule, error) {
+	names := map[string]struct{}{ratelimit.DefaultGroup: {}}
+	groups := make([]ratelimit.Group, 0, len(v.Groups))
+	for i, g := range v.Groups {
+		key := fmt.Sprintf("rate_limit.groups[%d].name", i)
+		if g.Name == "" {
+			return nil, nil, missedKey(key)
+		}
+		if _, ok := names[g.Name]; ok {
+			return nil, nil, InvalidKey(key, g.Name, errors.New("duplicate name"))
+		}
+		names[g.Name] = struct{}{}
+		groups = append(groups, ratelimit.Group{Name: g.Name, Users: g.Users})
+	}
+
+	seen := make(map[string]struct{}, len(v.Rules))
+	rules := make([]ratelimit.Rule, 0, len(v.Rules))
+	for i, r := range v.Rules {
+		key := fmt.Sprintf("rate_limit.rules[%d]", i)
+		group := r.Group
+		if group == "" {
+			group = ratelimit.DefaultGroup
+		}
+		if _, ok := names[group]; !ok {
+			return nil, nil, InvalidKey(key+".group", r.Group, errors.New("unknown group"))
+		}
+		if r.Route != "" && !strings.HasPrefix(r.Route, "/") {
+			return nil, nil, InvalidKey(key+".route", r.Route, errors.New("route must start with /"))
+		}
+		if _, ok := seen[group+" "+r.Route]; ok {
+			return nil, nil, InvalidKey(key, r.String(), errors.New("duplicate group and route"))
+		}
+		seen[group+" "+r.Route] = struct{}{}
+		rules = append(rules, ratelimit.Rule{
+			Group:    group,
+			Route:    r.Route,
+			Requests: int64(r.Requests),
+			Tokens:   int64(r.Tokens),
+			Streams:  int64(r.Streams),
+		})
+	}
+	return groups, rules, nil
+}
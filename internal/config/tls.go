@@ -0,0 +1,69 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"strings"
+
+	"github.com/lenye/aichat/pkg/web/certs"
+)
+
+// WebTLSConfig web server 的 https 配置，cert_file 和 key_file 都为空时使用 http
+type WebTLSConfig struct {
+	CertFile   string `json:"cert_file,omitempty"`   // 证书，可以包含中间证书，文件变化时自动重新加载
+	KeyFile    string `json:"key_file,omitempty"`    // 私钥
+	MinVersion string `json:"min_version,omitempty"` // 最低版本 1.0, 1.1, 1.2, 1.3
+	ClientCA   string `json:"client_ca,omitempty"`   // 校验客户端证书的 ca 证书，客户端证书的 CN 作为登录的用户
+	ClientAuth string `json:"client_auth,omitempty"` // 客户端证书的校验方式 require, optional
+}
+
+// Enabled 是否使用 https
+func (v *WebTLSConfig) Enabled() bool {
+	return v != nil && v.CertFile != ""
+}
+
+// Certs certs.NewReloader 的配置
+func (v *WebTLSConfig) Certs() certs.Config {
+	return certs.Config{
+		CertFile:   v.CertFile,
+		KeyFile:    v.KeyFile,
+		MinVersion: v.MinVersion,
+		ClientCA:   v.ClientCA,
+		ClientAuth: v.ClientAuth,
+	}
+}
+
+func checkWebTLSConfig(v *WebTLSConfig) error {
+	if v.CertFile == "" && v.KeyFile == "" {
+		if v.ClientCA != "" {
+			return missedKey("web.tls.cert_file")
+		}
+		return nil
+	}
+	if v.CertFile == "" {
+		return missedKey("web.tls.cert_file")
+	}
+	if v.KeyFile == "" {
+		return missedKey("web.tls.key_file")
+	}
+	if _, err := certs.ParseMinVersion(v.MinVersion); err != nil {
+		return InvalidKey("web.tls.min_version", v.MinVersion, nil)
+	}
+	v.ClientAuth = strings.ToLower(v.ClientAuth)
+	if !certs.ValidClientAuth(v.ClientAuth) {
+		return InvalidKey("web.tls.client_auth", v.ClientAuth, nil)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/lenye/aichat/pkg/tracing"
+)
+
+// TracingConfig opentelemetry 链路追踪配置，只在 web 模式下使用，修改后需要重启
+type TracingConfig struct {
+	Exporter    string  `json:"exporter,omitempty"`     // 导出方式 none, stdout, file, otlp
+	Endpoint    string  `json:"endpoint,omitempty"`     // otlp 的地址，如 http://localhost:4318
+	File        string  `json:"file,omitempty"`         // file 导出的文件
+	SampleRatio float64 `json:"sample_ratio,omitempty"` // 采样比例，0~1
+}
+
+// Tracing tracing.Setup 的配置
+func (v *TracingConfig) Tracing() tracing.Config {
+	return tracing.Config{
+		Exporter:    v.Exporter,
+		Endpoint:    v.Endpoint,
+		File:        v.File,
+		SampleRatio: v.SampleRatio,
+	}
+}
+
+func checkTracingConfig(v *TracingConfig) error {
+	v.Exporter = strings.ToLower(v.Exporter)
+	if !tracing.ValidExporter(v.Exporter) {
+		return InvalidKey("tracing.exporter", v.Exporter, nil)
+	}
+	if v.SampleRatio < 0 || v.SampleRatio > 1 {
+		return InvalidKey("tracing.sample_ratio", v.SampleRatio, errors.New("want 0~1"))
+	}
+	switch v.Exporter {
+	case tracing.ExporterFile:
+		if v.File == "" {
+			return missedKey("tracing.file")
+		}
+	case tracing.ExporterOTLP:
+		if v.Endpoint != "" {
+			if _, err := url.Parse(v.Endpoint); err != nil {
+				return InvalidKey("tracing.endpoint", v.Endpoint, err)
+			}
+		}
+	}
+	return nil
+}
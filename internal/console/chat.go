@@ -20,24 +20,62 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"os/signal"
 	"strings"
 
 	"github.com/sashabaranov/go-openai"
 
 	"github.com/lenye/aichat/internal/chatgpt"
+	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/internal/conversation"
+	"github.com/lenye/aichat/internal/provider"
+	"github.com/lenye/aichat/pkg/web/logging"
 )
 
-const promptInput = "(Press 'q' to quit) > "
+const promptInput = "(Press 'q' to quit, '/help' for commands) > "
 
-func Chat(client *openai.Client, in *chatgpt.Message) {
-	ctx := context.Background()
-	var hisMsg []openai.ChatCompletionMessage // 聊天记录
+// session 命令行会话
+type session struct {
+	client provider.Provider
+	cfg    *config.OpenAIConfig
+	in     *chatgpt.Message
+	store  conversation.ConversationStore
+	conv   *conversation.Conversation
+	failed bool // 最近一次提问失败，in.Prompt 为失败的提示语
+}
+
+// Chat 命令行聊天，conv=已打开的会话，每轮对话后保存
+func Chat(client provider.Provider,
+	cfg *config.OpenAIConfig,
+	in *chatgpt.Message,
+	store conversation.ConversationStore,
+	conv *conversation.Conversation) {
+	// 只显示警告以上的日志，例如换用备用后端，不打断聊天内容
+	ctx := logging.WithContext(context.Background(),
+		slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	sess := &session{
+		client: client,
+		cfg:    cfg,
+		in:     in,
+		store:  store,
+		conv:   conv,
+	}
 	// 会话
 	fmt.Println("---------------------")
+	fmt.Printf("session: %s\n", conv.ID)
 	if in.System != "" {
 		fmt.Println(in.System)
 	}
+	// 恢复的聊天记录
+	for _, msg := range conv.Messages {
+		if msg.Role == openai.ChatMessageRoleUser {
+			fmt.Printf("%s%s\n", promptInput, msg.Content)
+		} else {
+			fmt.Printf("%s\n\n", msg.Content)
+		}
+	}
 	fmt.Print(promptInput)
 
 	// 用户输入
@@ -48,32 +86,91 @@ func Chat(client *openai.Client, in *chatgpt.Message) {
 			if input == "q" {
 				return
 			}
-			in.Prompt = input
-			req := chatgpt.MakeChatRequest(in, hisMsg)
-			if msg, err := chatCompletion(ctx, client, req); err == nil {
-				// 保存聊天记录
-				hisMsg = append(hisMsg, req.Messages[len(req.Messages)-1])
-				hisMsg = append(hisMsg, *msg)
+			if strings.HasPrefix(input, commandPrefix) {
+				sess.command(ctx, input)
+			} else {
+				sess.send(ctx, input)
 			}
 		}
 		fmt.Print(promptInput)
 	}
 }
 
+// send 提问并保存聊天记录
+func (s *session) send(ctx context.Context, prompt string) {
+	s.in.Prompt = prompt
+	s.in.Summary = s.conv.Summary
+	req, trimmed, err := chatgpt.MakeChatRequest(ctx, s.in, s.conv.Recent(s.in.History))
+	if err != nil {
+		fmt.Printf("%s\n\n", err)
+		return
+	}
+	if !trimmed.Empty() {
+		fmt.Printf("(context window: dropped %d, truncated %d history messages, %d tokens)\n",
+			trimmed.Messages, trimmed.Truncated, trimmed.Tokens)
+	}
+	// 生成期间 Ctrl-C 停止生成，保留已生成的部分
+	genCtx, stop := interruptible(ctx)
+	msg, err := chatCompletion(genCtx, s.client, req)
+	stop()
+	if err != nil {
+		s.failed = true
+		return
+	}
+	s.failed = false
+	// 保存聊天记录
+	turn := []openai.ChatCompletionMessage{req.Messages[len(req.Messages)-1], *msg}
+	s.conv.Messages = append(s.conv.Messages, turn...)
+	if err := s.store.Append(s.conv.ID, turn...); err != nil {
+		fmt.Printf("save session failed, cause: %s\n\n", err)
+	}
+	s.summarize(ctx)
+}
+
+// summarize 聊天记录过长时，把较早的部分合并到会话摘要
+func (s *session) summarize(ctx context.Context) {
+	if _, upto := s.conv.ToSummarize(s.cfg.SummaryThreshold); upto == 0 {
+		return
+	}
+	fmt.Print("(summarizing earlier conversation...)\n\n")
+	ok, err := chatgpt.SummarizeConversation(ctx, s.client, s.cfg.SummaryModel, s.cfg.SummaryThreshold, s.conv)
+	if err != nil {
+		fmt.Printf("summarize failed, cause: %s\n\n", err)
+		return
+	}
+	if ok {
+		s.save()
+	}
+}
+
+// save 保存会话的全部内容
+func (s *session) save() {
+	s.conv.Model = s.in.Model
+	s.conv.System = s.in.System
+	s.conv.MaxTokens = s.in.MaxTokens
+	if err := s.store.Update(s.conv); err != nil {
+		fmt.Printf("save session failed, cause: %s\n\n", err)
+	}
+}
+
 func chatCompletion(ctx context.Context,
-	client *openai.Client,
+	client provider.Provider,
 	req *openai.ChatCompletionRequest) (*openai.ChatCompletionMessage, error) {
 	if req.Stream {
-		chatStream, err := client.CreateChatCompletionStream(ctx, *req)
+		chatStream, err := client.CreateChatStream(ctx, req)
 		if err != nil {
-			fmt.Printf("CreateChatCompletionStream faild, cause: %s\n\n", err)
+			if chatgpt.Stopped(ctx) {
+				fmt.Print("(stopped)\n\n")
+				return nil, chatgpt.ErrStopped
+			}
+			fmt.Printf("CreateChatStream faild, cause: %s\n\n", err)
 			return nil, err
 		}
 		defer chatStream.Close()
 
 		var sb strings.Builder
 		for {
-			resp, err := chatStream.Recv()
+			delta, err := chatStream.Recv()
 			if err != nil {
 				// Stream finished
 				if errors.Is(err, io.EOF) {
@@ -82,25 +179,59 @@ func chatCompletion(ctx context.Context,
 						Role:    openai.ChatMessageRoleAssistant,
 						Content: sb.String(),
 					}, nil
+				} else if chatgpt.Stopped(ctx) {
+					fmt.Print("\n(stopped)\n\n")
+					if sb.Len() == 0 {
+						return nil, chatgpt.ErrStopped
+					}
+					return &openai.ChatCompletionMessage{
+						Role:    openai.ChatMessageRoleAssistant,
+						Content: sb.String(),
+					}, nil
 				} else {
 					fmt.Printf("\n\nstream read faild, cause: %s\n\n", err)
 					return nil, err
 				}
 			}
 
-			msgContent := resp.Choices[0].Delta.Content
-			sb.WriteString(msgContent)
-			fmt.Printf("%s", msgContent)
+			sb.WriteString(delta.Content)
+			fmt.Printf("%s", delta.Content)
 		}
 	}
 
-	resp, err := client.CreateChatCompletion(ctx, *req)
+	resp, err := client.CreateChat(ctx, req)
 	if err != nil {
-		fmt.Printf("CreateChatCompletion faild, cause: %s\n\n", err)
+		if chatgpt.Stopped(ctx) {
+			fmt.Print("(stopped)\n\n")
+			return nil, chatgpt.ErrStopped
+		}
+		fmt.Printf("CreateChat faild, cause: %s\n\n", err)
 		return nil, err
 	}
 	// ai 回复
-	fmt.Printf("%s\n\n", resp.Choices[0].Message.Content)
+	fmt.Printf("%s\n\n", resp.Content)
 
-	return &resp.Choices[0].Message, nil
+	return &openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleAssistant,
+		Content: resp.Content,
+	}, nil
+}
+
+// interruptible 返回的 ctx 在 Ctrl-C 时取消，原因为 chatgpt.ErrStopped；
+// 调用 stop 后 Ctrl-C 恢复为退出程序
+func interruptible(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		select {
+		case <-sig:
+			cancel(chatgpt.ErrStopped)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sig)
+		cancel(nil)
+	}
 }
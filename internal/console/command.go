@@ -0,0 +1,212 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package console
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/lenye/aichat/internal/provider"
+	"github.com/lenye/aichat/pkg/project"
+)
+
+const commandPrefix = "/"
+
+// command 会话中的命令
+type command struct {
+	name  string
+	args  string // 参数说明
+	usage string
+	run   func(ctx context.Context, s *session, arg string) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{name: "system", args: "<text>", usage: "set the system prompt", run: cmdSystem},
+		{name: "model", args: "[name]", usage: "set the chat model, or list the available models", run: cmdModel},
+		{name: "max_tokens", args: "<n>", usage: "set the max tokens of a reply, 0 = unlimited", run: cmdMaxTokens},
+		{name: "history", args: "<n>", usage: "set the number of history messages sent with a prompt", run: cmdHistory},
+		{name: "clear", usage: "clear the conversation history", run: cmdClear},
+		{name: "retry", usage: "re-send the last prompt", run: cmdRetry},
+		{name: "undo", usage: "drop the last prompt and reply", run: cmdUndo},
+		{name: "save", args: "<file>", usage: "write the conversation transcript to a file", run: cmdSave},
+		{name: "help", usage: "list the commands", run: cmdHelp},
+	}
+}
+
+// command 执行会话命令, input="/name arg"
+func (s *session) command(ctx context.Context, input string) {
+	name, arg, _ := strings.Cut(strings.TrimPrefix(input, commandPrefix), " ")
+	arg = strings.TrimSpace(arg)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(ctx, s, arg); err != nil {
+				fmt.Printf("%s%s: %s\n\n", commandPrefix, name, err)
+			}
+			return
+		}
+	}
+	fmt.Printf("unknown command: %q, type /help for the commands\n\n", input)
+}
+
+func cmdSystem(_ context.Context, s *session, arg string) error {
+	system, err := project.StrRaw2Interpreted(arg)
+	if err != nil {
+		system = arg
+	}
+	s.in.System = system
+	s.save()
+	if system == "" {
+		fmt.Print("system prompt cleared\n\n")
+	} else {
+		fmt.Printf("system prompt: %s\n\n", system)
+	}
+	return nil
+}
+
+func cmdModel(ctx context.Context, s *session, arg string) error {
+	models, err := provider.Models(ctx, s.client)
+	if err != nil && !errors.Is(err, provider.ErrModelsUnsupported) {
+		fmt.Printf("list models failed, cause: %s\n", err)
+	}
+	if arg == "" {
+		fmt.Printf("model: %s\n", s.in.Model)
+		if len(models) > 0 {
+			fmt.Println("available models:")
+			for _, m := range models {
+				fmt.Printf("  %s\n", m)
+			}
+		}
+		fmt.Println()
+		return nil
+	}
+	if len(models) > 0 && !slices.Contains(models, arg) {
+		fmt.Printf("warning: %q is not in the available models, type /model to list them\n", arg)
+	}
+	s.in.Model = arg
+	s.save()
+	fmt.Printf("model: %s\n\n", s.in.Model)
+	return nil
+}
+
+func cmdMaxTokens(_ context.Context, s *session, arg string) error {
+	n, err := strconv.ParseUint(arg, 10, 0)
+	if err != nil {
+		return fmt.Errorf("invalid number: %q", arg)
+	}
+	s.in.MaxTokens = uint(n)
+	s.save()
+	fmt.Printf("max_tokens: %d\n\n", s.in.MaxTokens)
+	return nil
+}
+
+func cmdHistory(_ context.Context, s *session, arg string) error {
+	n, err := strconv.ParseUint(arg, 10, 0)
+	if err != nil {
+		return fmt.Errorf("invalid number: %q", arg)
+	}
+	s.in.History = uint(n)
+	fmt.Printf("history: %d\n\n", s.in.History)
+	return nil
+}
+
+func cmdClear(_ context.Context, s *session, _ string) error {
+	s.conv.Messages = nil
+	s.conv.ClearSummary()
+	s.failed = false
+	s.save()
+	fmt.Print("history cleared\n\n")
+	return nil
+}
+
+// lastTurn 最后一轮对话的位置，没有时返回 -1
+func (s *session) lastTurn() int {
+	for i := len(s.conv.Messages) - 1; i >= 0; i-- {
+		if s.conv.Messages[i].Role == openai.ChatMessageRoleUser {
+			return i
+		}
+	}
+	return -1
+}
+
+func cmdRetry(ctx context.Context, s *session, _ string) error {
+	// 最近一次提问失败，直接重发
+	if s.failed {
+		s.send(ctx, s.in.Prompt)
+		return nil
+	}
+	i := s.lastTurn()
+	if i < 0 {
+		return errors.New("no prompt to retry")
+	}
+	prompt := s.conv.Messages[i].Content
+	s.conv.Messages = s.conv.Messages[:i]
+	s.conv.Summarized = min(s.conv.Summarized, i)
+	s.save()
+	s.send(ctx, prompt)
+	return nil
+}
+
+func cmdUndo(_ context.Context, s *session, _ string) error {
+	i := s.lastTurn()
+	if i < 0 {
+		return errors.New("no prompt to undo")
+	}
+	s.conv.Messages = s.conv.Messages[:i]
+	s.conv.Summarized = min(s.conv.Summarized, i)
+	s.failed = false
+	s.save()
+	fmt.Print("last prompt and reply dropped\n\n")
+	return nil
+}
+
+func cmdSave(_ context.Context, s *session, arg string) error {
+	if arg == "" {
+		return errors.New("missed file name")
+	}
+	var sb strings.Builder
+	if s.in.System != "" {
+		fmt.Fprintf(&sb, "[%s]\n%s\n\n", openai.ChatMessageRoleSystem, s.in.System)
+	}
+	if s.conv.Summary != "" {
+		fmt.Fprintf(&sb, "[summary]\n%s\n\n", s.conv.Summary)
+	}
+	for _, msg := range s.conv.Messages {
+		fmt.Fprintf(&sb, "[%s]\n%s\n\n", msg.Role, msg.Content)
+	}
+	if err := os.WriteFile(arg, []byte(sb.String()), project.ModePerm0644); err != nil {
+		return err
+	}
+	fmt.Printf("transcript saved to %s\n\n", arg)
+	return nil
+}
+
+func cmdHelp(_ context.Context, _ *session, _ string) error {
+	for _, cmd := range commands {
+		fmt.Printf("  %-24s %s\n", commandPrefix+cmd.name+" "+cmd.args, cmd.usage)
+	}
+	fmt.Printf("  %-24s %s\n", "Ctrl-C", "stop the answer being generated, keep the partial answer")
+	fmt.Printf("  %-24s %s\n\n", "q", "quit")
+	return nil
+}
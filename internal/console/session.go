@@ -0,0 +1,102 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package console
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lenye/aichat/internal/chatgpt"
+	"github.com/lenye/aichat/internal/conversation"
+)
+
+const sessionNameLayout = "20060102-150405"
+
+// OpenSession 打开命令行会话
+//
+// name 不为空时，打开该名称的会话，不存在则新建；
+// latest=true 时，打开最近使用的会话；
+// 否则新建一个以当前时间命名的会话。
+// 打开已保存的会话时，in 的系统提示语、模型和最大tokens会被恢复为会话保存的值。
+func OpenSession(store conversation.ConversationStore, name string, latest bool, in *chatgpt.Message) (*conversation.Conversation, error) {
+	if name == "" && latest {
+		list, err := Sessions(store)
+		if err != nil {
+			return nil, err
+		}
+		if len(list) == 0 {
+			return nil, errors.New("no saved session to continue")
+		}
+		name = list[0].ID
+	}
+	if name == "" {
+		name = time.Now().Format(sessionNameLayout)
+	}
+
+	conv, err := conversation.LoadOrCreate(store, &conversation.Conversation{
+		ID:        name,
+		Source:    conversation.SourceConsole,
+		Model:     in.Model,
+		System:    in.System,
+		MaxTokens: in.MaxTokens,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open session %q failed, cause: %w", name, err)
+	}
+
+	// 恢复会话
+	if conv.Model != "" {
+		in.Model = conv.Model
+	}
+	in.System = conv.System
+	in.MaxTokens = conv.MaxTokens
+
+	return conv, nil
+}
+
+// Sessions 命令行会话列表，按更新时间倒序
+func Sessions(store conversation.ConversationStore) ([]*conversation.Conversation, error) {
+	list, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*conversation.Conversation
+	for _, v := range list {
+		if v.Source == conversation.SourceConsole {
+			sessions = append(sessions, v)
+		}
+	}
+	return sessions, nil
+}
+
+// PrintSessions 打印命令行会话列表
+func PrintSessions(w io.Writer, store conversation.ConversationStore) error {
+	list, err := Sessions(store)
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		_, err = fmt.Fprintln(w, "no saved sessions")
+		return err
+	}
+	for _, v := range list {
+		if _, err := fmt.Fprintf(w, "%-24s %-20s %s\n", v.ID, v.Model, v.UpdatedAt.Format(time.DateTime)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
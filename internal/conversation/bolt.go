@@ -0,0 +1,170 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conversation
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/lenye/aichat/pkg/project"
+)
+
+var bucketConversations = []byte("conversations")
+
+// BoltStore 会话保存在嵌入式数据库 bbolt
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore 打开 bbolt 数据库文件
+func NewBoltStore(path string) (*BoltStore, error) {
+	if err := project.CreateDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	// 数据库文件被其他进程锁定时，不要一直等待
+	db, err := bolt.Open(path, project.ModePerm0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("bolt.Open failed, path: %q, cause: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketConversations)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func boltGet(b *bolt.Bucket, id string) (*Conversation, error) {
+	data := b.Get([]byte(id))
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	v := new(Conversation)
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed, conversation: %q, cause: %w", id, err)
+	}
+	return v, nil
+}
+
+func boltPut(b *bolt.Bucket, c *Conversation) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(c.ID), data)
+}
+
+func (s *BoltStore) Create(c *Conversation) error {
+	if err := validID(c.ID); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketConversations)
+		if b.Get([]byte(c.ID)) != nil {
+			return ErrExists
+		}
+		now := time.Now()
+		if c.CreatedAt.IsZero() {
+			c.CreatedAt = now
+		}
+		c.UpdatedAt = now
+		return boltPut(b, c)
+	})
+}
+
+func (s *BoltStore) Append(id string, msgs ...openai.ChatCompletionMessage) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketConversations)
+		c, err := boltGet(b, id)
+		if err != nil {
+			return err
+		}
+		c.Messages = append(c.Messages, msgs...)
+		c.UpdatedAt = time.Now()
+		return boltPut(b, c)
+	})
+}
+
+func (s *BoltStore) Update(c *Conversation) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketConversations)
+		if b.Get([]byte(c.ID)) == nil {
+			return ErrNotFound
+		}
+		c.UpdatedAt = time.Now()
+		return boltPut(b, c)
+	})
+}
+
+func (s *BoltStore) UpdateSummary(id string, from int, summary string, upto int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketConversations)
+		c, err := boltGet(b, id)
+		if err != nil {
+			return err
+		}
+		if err := setSummary(c, from, summary, upto); err != nil {
+			return err
+		}
+		return boltPut(b, c)
+	})
+}
+
+func (s *BoltStore) List() ([]*Conversation, error) {
+	var list []*Conversation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketConversations).ForEach(func(k, data []byte) error {
+			v := new(Conversation)
+			if err := json.Unmarshal(data, v); err != nil {
+				return fmt.Errorf("json.Unmarshal failed, conversation: %q, cause: %w", k, err)
+			}
+			list = append(list, summary(v))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortByUpdated(list)
+	return list, nil
+}
+
+func (s *BoltStore) Load(id string) (*Conversation, error) {
+	var v *Conversation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		v, err = boltGet(tx.Bucket(bucketConversations), id)
+		return err
+	})
+	return v, err
+}
+
+func (s *BoltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketConversations).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,188 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conversation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/lenye/aichat/pkg/project"
+)
+
+const fileExt = ".json"
+
+// FileStore 每个会话保存为目录下的一个json文件
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileStore 创建json文件存储
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := project.CreateDir(dir); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) filename(id string) string {
+	return filepath.Join(s.dir, id+fileExt)
+}
+
+func (s *FileStore) read(id string) (*Conversation, error) {
+	if err := validID(id); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(s.filename(id))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	v := new(Conversation)
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed, conversation: %q, cause: %w", id, err)
+	}
+	return v, nil
+}
+
+// write 先写入临时文件再改名，避免写入中断导致文件损坏
+func (s *FileStore) write(c *Conversation) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	name := s.filename(c.ID)
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, b, project.ModePerm0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (s *FileStore) Create(c *Conversation) error {
+	if err := validID(c.ID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(s.filename(c.ID)); err == nil {
+		return ErrExists
+	}
+	now := time.Now()
+	if c.CreatedAt.IsZero() {
+		c.CreatedAt = now
+	}
+	c.UpdatedAt = now
+	return s.write(c)
+}
+
+func (s *FileStore) Append(id string, msgs ...openai.ChatCompletionMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, err := s.read(id)
+	if err != nil {
+		return err
+	}
+	c.Messages = append(c.Messages, msgs...)
+	c.UpdatedAt = time.Now()
+	return s.write(c)
+}
+
+func (s *FileStore) Update(c *Conversation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.read(c.ID); err != nil {
+		return err
+	}
+	c.UpdatedAt = time.Now()
+	return s.write(c)
+}
+
+func (s *FileStore) UpdateSummary(id string, from int, summary string, upto int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, err := s.read(id)
+	if err != nil {
+		return err
+	}
+	if err := setSummary(c, from, summary, upto); err != nil {
+		return err
+	}
+	return s.write(c)
+}
+
+func (s *FileStore) List() ([]*Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []*Conversation
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), fileExt) {
+			continue
+		}
+		c, err := s.read(strings.TrimSuffix(entry.Name(), fileExt))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, summary(c))
+	}
+	sortByUpdated(list)
+	return list, nil
+}
+
+func (s *FileStore) Load(id string) (*Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.read(id)
+}
+
+func (s *FileStore) Delete(id string) error {
+	if err := validID(id); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.filename(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
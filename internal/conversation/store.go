@@ -0,0 +1,188 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conversation
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	StoreFile = "file" // json文件
+	StoreBolt = "bolt" // 嵌入式数据库 bbolt
+)
+
+const (
+	SourceConsole = "console" // 命令行模式的会话
+	SourceWeb     = "web"     // web模式的会话
+	SourceAPI     = "api"     // json api 的会话
+)
+
+var (
+	ErrNotFound = errors.New("conversation not found")
+	ErrExists   = errors.New("conversation already exists")
+	ErrInvalid  = errors.New("invalid conversation id")
+	ErrConflict = errors.New("conversation changed")
+)
+
+// Conversation 会话
+type Conversation struct {
+	ID        string                         `json:"id"`
+	User      string                         `json:"user,omitempty"`
+	Source    string                         `json:"source,omitempty"` // 会话来源 console, web
+	Title     string                         `json:"title,omitempty"`
+	Model     string                         `json:"model,omitempty"`
+	System    string                         `json:"system,omitempty"`
+	MaxTokens uint                           `json:"max_tokens,omitempty"`
+	Messages  []openai.ChatCompletionMessage `json:"messages,omitempty"` // 不含系统提示语的聊天记录
+	// Summary 较早聊天记录的摘要，Summarized=摘要已包含的聊天记录条数（从头开始计算）
+	Summary    string    `json:"summary,omitempty"`
+	Summarized int       `json:"summarized,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Recent 最近的 pairs 条未被摘要的聊天记录（一问一答为一条）
+func (c *Conversation) Recent(pairs uint) []openai.ChatCompletionMessage {
+	if pairs == 0 {
+		return nil
+	}
+	msgs := c.Messages[min(c.Summarized, len(c.Messages)):]
+	if n := int(pairs) * 2; len(msgs) > n {
+		msgs = msgs[len(msgs)-n:]
+	}
+	return append([]openai.ChatCompletionMessage(nil), msgs...)
+}
+
+// ToSummarize 未被摘要的聊天记录超过 threshold 条时，返回需要摘要的较早部分，
+// 保留最近 threshold/2 条（至少1条）不摘要；upto=摘要后 Summarized 的值
+func (c *Conversation) ToSummarize(threshold uint) (msgs []openai.ChatCompletionMessage, upto int) {
+	if threshold == 0 {
+		return nil, 0
+	}
+	from := min(c.Summarized, len(c.Messages))
+	pairs := (len(c.Messages) - from) / 2
+	if pairs <= int(threshold) {
+		return nil, 0
+	}
+	keep := max(int(threshold)/2, 1)
+	upto = len(c.Messages) - keep*2
+	return c.Messages[from:upto], upto
+}
+
+// ClearSummary 清除摘要
+func (c *Conversation) ClearSummary() {
+	c.Summary = ""
+	c.Summarized = 0
+}
+
+// ConversationStore 会话持久化存储
+type ConversationStore interface {
+	// Create 创建会话，会话已存在时返回 ErrExists
+	Create(c *Conversation) error
+	// Append 追加聊天记录，会话不存在时返回 ErrNotFound
+	Append(id string, msgs ...openai.ChatCompletionMessage) error
+	// Update 保存会话的全部内容，会话不存在时返回 ErrNotFound
+	Update(c *Conversation) error
+	// UpdateSummary 只更新会话的摘要和 Summarized，不改动聊天记录；
+	// 会话的 Summarized 不等于 from（期间已被摘要或者清除）或者聊天记录少于 upto 条时返回 ErrConflict
+	UpdateSummary(id string, from int, summary string, upto int) error
+	// List 会话列表，按更新时间倒序，不含聊天记录
+	List() ([]*Conversation, error)
+	// Load 读取会话，会话不存在时返回 ErrNotFound
+	Load(id string) (*Conversation, error)
+	// Delete 删除会话
+	Delete(id string) error
+	// Close 关闭存储
+	Close() error
+}
+
+var defaultStore atomic.Value
+
+// Default returns the default ConversationStore.
+func Default() ConversationStore {
+	v, _ := defaultStore.Load().(ConversationStore)
+	return v
+}
+
+// SetDefault makes v the default ConversationStore.
+func SetDefault(v ConversationStore) {
+	defaultStore.Store(v)
+}
+
+// Open 打开会话存储，storeType: file, bolt; dir=存储目录
+func Open(storeType, dir string) (ConversationStore, error) {
+	switch strings.ToLower(storeType) {
+	case StoreFile:
+		return NewFileStore(filepath.Join(dir, "conversations"))
+	case StoreBolt:
+		return NewBoltStore(filepath.Join(dir, "aichat.db"))
+	default:
+		return nil, fmt.Errorf("invalid store type: %q", storeType)
+	}
+}
+
+// LoadOrCreate 读取会话，不存在时用 c 创建
+func LoadOrCreate(s ConversationStore, c *Conversation) (*Conversation, error) {
+	v, err := s.Load(c.ID)
+	if err == nil {
+		return v, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err := s.Create(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// setSummary 会话的 Summarized 仍为 from 时更新摘要，否则返回 ErrConflict
+func setSummary(c *Conversation, from int, summary string, upto int) error {
+	if c.Summarized != from || upto > len(c.Messages) {
+		return ErrConflict
+	}
+	c.Summary = summary
+	c.Summarized = upto
+	return nil
+}
+
+// summary 会话摘要，不含聊天记录
+func summary(c *Conversation) *Conversation {
+	v := *c
+	v.Messages = nil
+	return &v
+}
+
+// sortByUpdated 按更新时间倒序
+func sortByUpdated(list []*Conversation) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].UpdatedAt.After(list[j].UpdatedAt)
+	})
+}
+
+func validID(id string) error {
+	if id == "" || strings.ContainsAny(id, `/\:`) || id == "." || id == ".." {
+		return fmt.Errorf("%w: %q", ErrInvalid, id)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api 版本化的 json api，供脚本和自定义前端使用
+//
+// 路由以 /api/v1 开头，错误统一为 {"error": {"code": "...", "message": "..."}}。
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lenye/aichat/internal/billing"
+	"github.com/lenye/aichat/internal/chatgpt"
+	"github.com/lenye/aichat/internal/conversation"
+	"github.com/lenye/aichat/pkg/web/auth"
+	"github.com/lenye/aichat/pkg/web/logging"
+	"github.com/lenye/aichat/pkg/web/render"
+)
+
+// maxRequestSize 请求的最大字节数
+const maxRequestSize = 1 << 20
+
+// decode 读取 json 请求，失败时返回 400
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			render.JSONError(w, r, http.StatusRequestEntityTooLarge, render.CodeBadRequest,
+				fmt.Sprintf("request body is larger than %d bytes", maxErr.Limit))
+			return false
+		}
+		render.JSONError(w, r, http.StatusBadRequest, render.CodeBadRequest,
+			fmt.Sprintf("invalid request body: %s", err))
+		return false
+	}
+	return true
+}
+
+// loadConversation 读取当前用户的会话，其他用户的会话视为不存在
+func loadConversation(r *http.Request, id string) (*conversation.Conversation, error) {
+	conv, err := conversation.Default().Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if !owned(r, conv) {
+		return nil, conversation.ErrNotFound
+	}
+	return conv, nil
+}
+
+// owned 不需要登录时可以访问全部会话
+func owned(r *http.Request, conv *conversation.Conversation) bool {
+	user := auth.UserFromContext(r.Context())
+	return user == "" || conv.User == user
+}
+
+// storeError 会话存储的错误
+func storeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, conversation.ErrNotFound):
+		render.JSONError(w, r, http.StatusNotFound, render.CodeNotFound, err.Error())
+	case errors.Is(err, conversation.ErrExists):
+		render.JSONError(w, r, http.StatusConflict, render.CodeConflict, err.Error())
+	case errors.Is(err, conversation.ErrInvalid):
+		render.JSONError(w, r, http.StatusBadRequest, render.CodeBadRequest, err.Error())
+	default:
+		logging.FromContext(r.Context()).Error("conversation store failed",
+			"error", err,
+		)
+		render.JSON500(w, r, err)
+	}
+}
+
+// 错误代码
+const (
+	codeInsufficientBalance = "insufficient_balance"
+	codeQuotaExceeded       = "quota_exceeded"
+	codePromptTooLong       = "prompt_too_long"
+)
+
+// refused 没有发送请求的错误: 余额或者额度不足，计费服务出错，或者创建提供方失败
+func refused(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, billing.ErrInsufficientBalance):
+		render.JSONError(w, r, http.StatusPaymentRequired, codeInsufficientBalance, err.Error())
+	case errors.Is(err, billing.ErrQuotaExceeded):
+		render.JSONError(w, r, http.StatusTooManyRequests, codeQuotaExceeded, err.Error())
+	default:
+		upstreamError(w, r, err)
+	}
+}
+
+// ServiceUnavailable 停止服务的 drain 期间拒绝新的聊天
+func ServiceUnavailable(w http.ResponseWriter, r *http.Request) {
+	render.JSONError(w, r, http.StatusServiceUnavailable, render.CodeUnavailable, "server is shutting down")
+}
+
+// upstreamError 聊天请求的错误，状态码见 chatgpt.ErrorStatus
+func upstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	logging.FromContext(r.Context()).Error("chat failed",
+		"error", err,
+	)
+	statusCode := chatgpt.ErrorStatus(err)
+	if !render.AllowedResponseCode(statusCode) {
+		statusCode = http.StatusBadGateway
+	}
+	render.JSONError(w, r, statusCode, render.CodeUpstream, err.Error())
+}
@@ -0,0 +1,107 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/internal/conversation"
+	"github.com/lenye/aichat/pkg/requestid"
+	"github.com/lenye/aichat/pkg/web/auth"
+	"github.com/lenye/aichat/pkg/web/render"
+)
+
+// createRequest 创建会话
+type createRequest struct {
+	ID        string `json:"id,omitempty"` // 为空时自动生成
+	Title     string `json:"title,omitempty"`
+	Model     string `json:"model,omitempty"` // 为空时使用 openai_model
+	System    string `json:"system,omitempty"`
+	MaxTokens uint   `json:"max_tokens,omitempty"`
+}
+
+// listResponse 会话列表
+type listResponse struct {
+	Data []*conversation.Conversation `json:"data"`
+}
+
+// CreateConversation POST /api/v1/conversations
+func CreateConversation(w http.ResponseWriter, r *http.Request) {
+	var in createRequest
+	if !decode(w, r, &in) {
+		return
+	}
+	if in.ID == "" {
+		in.ID = requestid.New()
+	}
+	if in.Model == "" {
+		in.Model = config.Default().OpenAI.Model
+	}
+	conv := &conversation.Conversation{
+		ID:        in.ID,
+		User:      auth.UserFromContext(r.Context()),
+		Source:    conversation.SourceAPI,
+		Title:     in.Title,
+		Model:     in.Model,
+		System:    in.System,
+		MaxTokens: in.MaxTokens,
+	}
+	if err := conversation.Default().Create(conv); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	render.JSONStatus(w, r, http.StatusCreated, conv)
+}
+
+// ListConversations GET /api/v1/conversations 按更新时间倒序，不含聊天记录
+func ListConversations(w http.ResponseWriter, r *http.Request) {
+	list, err := conversation.Default().List()
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	data := make([]*conversation.Conversation, 0, len(list))
+	for _, conv := range list {
+		if owned(r, conv) {
+			data = append(data, conv)
+		}
+	}
+	render.JSON(w, r, &listResponse{Data: data})
+}
+
+// GetConversation GET /api/v1/conversations/{id}
+func GetConversation(w http.ResponseWriter, r *http.Request) {
+	conv, err := loadConversation(r, r.PathValue("id"))
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	render.JSON(w, r, conv)
+}
+
+// DeleteConversation DELETE /api/v1/conversations/{id}
+func DeleteConversation(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := loadConversation(r, id); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	if err := conversation.Default().Delete(id); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	render.JSONNoContent(w)
+}
@@ -0,0 +1,255 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/lenye/aichat/internal/chatgpt"
+	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/internal/conversation"
+	"github.com/lenye/aichat/internal/provider"
+	"github.com/lenye/aichat/pkg/web/logging"
+	"github.com/lenye/aichat/pkg/web/render"
+)
+
+// messageRequest 发送消息，未设置的参数使用会话或者配置的值
+type messageRequest struct {
+	Prompt    string `json:"prompt"`
+	Stream    bool   `json:"stream,omitempty"` // true=以 sse 事件流返回
+	Model     string `json:"model,omitempty"`
+	History   *uint  `json:"history,omitempty"`
+	MaxTokens *uint  `json:"max_tokens,omitempty"`
+}
+
+// messageResponse 回复
+type messageResponse struct {
+	ConversationID string                       `json:"conversation_id"`
+	Message        openai.ChatCompletionMessage `json:"message"`
+	FinishReason   openai.FinishReason          `json:"finish_reason,omitempty"`
+	Usage          *openai.Usage                `json:"usage,omitempty"`
+}
+
+// deltaEvent 流模式的增量
+type deltaEvent struct {
+	Content string `json:"content"`
+}
+
+// PostMessage POST /api/v1/conversations/{id}/messages
+//
+// 非流模式返回 messageResponse；流模式返回 sse 事件流:
+// delta 事件为增量内容，done 事件为完整的 messageResponse，error 事件为错误。
+func PostMessage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	var in messageRequest
+	if !decode(w, r, &in) {
+		return
+	}
+	if strings.TrimSpace(in.Prompt) == "" {
+		render.JSONError(w, r, http.StatusBadRequest, render.CodeBadRequest, "prompt is required")
+		return
+	}
+
+	conv, err := loadConversation(r, r.PathValue("id"))
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+
+	cfg := config.Default()
+	msg := &chatgpt.Message{
+		StreamID:      conv.ID,
+		User:          conv.User,
+		Model:         conv.Model,
+		Prompt:        in.Prompt,
+		System:        conv.System,
+		Stream:        in.Stream,
+		History:       cfg.OpenAI.History,
+		MaxTokens:     conv.MaxTokens,
+		ContextWindow: cfg.OpenAI.ContextWindow,
+		Summary:       conv.Summary,
+	}
+	if in.Model != "" {
+		msg.Model = in.Model
+	}
+	if msg.Model == "" {
+		msg.Model = cfg.OpenAI.Model
+	}
+	if in.History != nil {
+		msg.History = *in.History
+	}
+	if in.MaxTokens != nil {
+		msg.MaxTokens = *in.MaxTokens
+	}
+
+	chatReq, trimmed, err := chatgpt.MakeChatRequest(ctx, msg, conv.Recent(msg.History))
+	if err != nil {
+		render.JSONError(w, r, http.StatusBadRequest, codePromptTooLong, err.Error())
+		return
+	}
+	if !trimmed.Empty() {
+		logger.Info("history trimmed to fit the context window",
+			"model", msg.Model,
+			"dropped", trimmed.Messages,
+			"truncated", trimmed.Truncated,
+			"tokens", trimmed.Tokens,
+		)
+	}
+
+	var resp *provider.Response
+	notice, err := chatgpt.ChatCompletion(ctx, "api.PostMessage", cfg, chatReq,
+		func(ctx context.Context, p provider.Provider) (*provider.Response, error) {
+			if in.Stream {
+				return streamMessage(w, r.WithContext(ctx), p, conv, chatReq)
+			}
+			var err error
+			resp, err = p.CreateChat(ctx, chatReq)
+			return resp, err
+		})
+	if notice != "" {
+		// 没有发送请求: 余额不足或者创建提供方失败
+		refused(w, r, err)
+		return
+	}
+	if in.Stream {
+		return
+	}
+	if err != nil {
+		upstreamError(w, r, err)
+		return
+	}
+	chatgpt.SaveConversation(ctx, conv, chatReq.Messages[len(chatReq.Messages)-1], resp.Content)
+
+	render.JSON(w, r, &messageResponse{
+		ConversationID: conv.ID,
+		Message: openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleAssistant,
+			Content: resp.Content,
+		},
+		FinishReason: resp.FinishReason,
+		Usage:        &resp.Usage,
+	})
+}
+
+// streamMessage 以 sse 事件流返回回复，第一个内容之前的错误返回 http 错误，之后的错误作为 error 事件发送。
+// 返回已收到的回复和用量，中途出错或者客户端断开时也按已收到的部分记录用量。
+func streamMessage(w http.ResponseWriter, r *http.Request,
+	p provider.Provider,
+	conv *conversation.Conversation,
+	chatReq *openai.ChatCompletionRequest) (*provider.Response, error) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		err := errors.New("streaming unsupported")
+		render.JSON500(w, r, err)
+		return nil, err
+	}
+
+	stream, err := p.CreateChatStream(ctx, chatReq)
+	if err != nil {
+		upstreamError(w, r, err)
+		return nil, err
+	}
+	defer stream.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// nginx 添加X-Accel-Buffering=no的响应header，来告诉nginx不要对响应数据进行缓存。
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event string, v any) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	var (
+		sb   strings.Builder
+		done = &messageResponse{ConversationID: conv.ID}
+		resp = new(provider.Response)
+	)
+	defer func() {
+		resp.Content = sb.String()
+		resp.FinishReason = done.FinishReason
+		if done.Usage != nil {
+			resp.Usage = *done.Usage
+		}
+	}()
+	for {
+		delta, err := stream.Recv()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Error("read stream failed",
+					"error", err,
+				)
+				_ = send("error", map[string]*render.ErrorBody{"error": {
+					Code:    render.CodeUpstream,
+					Message: err.Error(),
+				}})
+				return resp, err
+			}
+			break
+		}
+		if delta.Content != "" {
+			sb.WriteString(delta.Content)
+			if err := send("delta", &deltaEvent{Content: delta.Content}); err != nil {
+				// client close
+				logger.Debug("write stream failed",
+					"error", err,
+				)
+				return resp, err
+			}
+		}
+		if delta.FinishReason != "" {
+			done.FinishReason = delta.FinishReason
+		}
+		if delta.Usage != nil {
+			done.Usage = delta.Usage
+		}
+		if delta.Model != "" {
+			resp.Model = delta.Model
+		}
+	}
+
+	done.Message = openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleAssistant,
+		Content: sb.String(),
+	}
+	if done.Message.Content != "" {
+		chatgpt.SaveConversation(ctx, conv, chatReq.Messages[len(chatReq.Messages)-1], done.Message.Content)
+	}
+	_ = send("done", done)
+	return resp, nil
+}
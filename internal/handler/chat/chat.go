@@ -41,6 +41,8 @@ func Chat(w http.ResponseWriter, r *http.Request) {
 	m["system"] = cfg.OpenAI.System
 	m["max_tokens"] = strconv.Itoa(int(cfg.OpenAI.MaxTokens))
 	m["history"] = strconv.Itoa(int(cfg.OpenAI.History))
+	m["models"] = availableModels(ctx)
+	m["generation_id"] = requestid.New()
 
 	render.Html(w, r, "chat.gohtml", m)
 }
@@ -61,7 +63,8 @@ func getStreamID(w http.ResponseWriter, r *http.Request) string {
 		}
 		http.SetCookie(w, cookie)
 	}
-	if len(cookie.Value) != 32 {
+	// 会话属于其他用户时（例如换了用户登录）使用新的会话
+	if len(cookie.Value) != 32 || !owned(r.Context(), cookie.Value) {
 		cookie = &http.Cookie{
 			Name:   cookieName,
 			Value:  requestid.New(),
@@ -0,0 +1,69 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chat
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lenye/aichat/internal/chatgpt"
+	"github.com/lenye/aichat/internal/conversation"
+	"github.com/lenye/aichat/pkg/web/auth"
+	"github.com/lenye/aichat/pkg/web/logging"
+)
+
+// loadConversation 读取会话，不存在时新建，存储出错时返回一个空的会话。
+// 会话属于其他用户时返回 false
+func loadConversation(ctx context.Context, in *chatgpt.Message) (*conversation.Conversation, bool) {
+	conv, err := conversation.LoadOrCreate(conversation.Default(), &conversation.Conversation{
+		ID:        in.StreamID,
+		User:      in.User,
+		Source:    conversation.SourceWeb,
+		Model:     in.Model,
+		System:    in.System,
+		MaxTokens: in.MaxTokens,
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("load conversation failed",
+			"error", err,
+			"stream_id", in.StreamID,
+		)
+		return &conversation.Conversation{ID: in.StreamID, User: in.User}, true
+	}
+	if in.User != "" && conv.User != in.User {
+		return nil, false
+	}
+	return conv, true
+}
+
+// owned 会话是否属于登录的用户，不需要登录或者会话还不存在时为 true
+func owned(ctx context.Context, id string) bool {
+	user := auth.UserFromContext(ctx)
+	if user == "" {
+		return true
+	}
+	conv, err := conversation.Default().Load(id)
+	if err != nil {
+		if errors.Is(err, conversation.ErrNotFound) {
+			return true
+		}
+		logging.FromContext(ctx).Error("load conversation failed",
+			"error", err,
+			"stream_id", id,
+		)
+		return false
+	}
+	return conv.User == user
+}
@@ -0,0 +1,121 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chat
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lenye/aichat/internal/chatgpt"
+	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/internal/provider"
+	"github.com/lenye/aichat/pkg/web/logging"
+)
+
+// modelsTTL 模型列表的缓存时间
+const modelsTTL = time.Minute
+
+// cachedModels 查询成功的模型列表
+type cachedModels struct {
+	cfg     *config.Configuration // 重新加载配置后缓存失效
+	models  []string
+	expires time.Time
+}
+
+// modelsCache 最近一次查询成功的模型列表，查询失败时不缓存
+var modelsCache atomic.Pointer[cachedModels]
+
+// modelsFlight 正在进行的查询，同时只查询一次，其它请求等待它的结果；
+// 锁只保护 done，查询上游时不持有锁
+var modelsFlight struct {
+	sync.Mutex
+	done chan struct{} // 查询结束时关闭
+}
+
+// availableModels 全部后端的可用模型，用于页面的模型选择，不支持查询时返回 nil
+func availableModels(ctx context.Context) []string {
+	conf := config.Default()
+	prev := modelsCache.Load()
+	if prev != nil && prev.cfg == conf && time.Now().Before(prev.expires) {
+		return prev.models
+	}
+
+	modelsFlight.Lock()
+	if done := modelsFlight.done; done != nil {
+		modelsFlight.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		if c := modelsCache.Load(); c != nil && c.cfg == conf {
+			return c.models
+		}
+		return nil
+	}
+	done := make(chan struct{})
+	modelsFlight.done = done
+	modelsFlight.Unlock()
+	defer func() {
+		modelsFlight.Lock()
+		modelsFlight.done = nil
+		modelsFlight.Unlock()
+		close(done)
+	}()
+
+	models, err := listModels(ctx, conf)
+	if err != nil {
+		// 查询失败不缓存，下一个请求重新查询；同一个配置有以前的结果时继续使用
+		if prev != nil && prev.cfg == conf {
+			return prev.models
+		}
+		return models
+	}
+	modelsCache.Store(&cachedModels{cfg: conf, models: models, expires: time.Now().Add(modelsTTL)})
+	return models
+}
+
+// listModels 查询全部后端的可用模型，部分后端查询失败时返回其余的模型和错误
+func listModels(ctx context.Context, conf *config.Configuration) ([]string, error) {
+	logger := logging.FromContext(ctx)
+	cfg := conf.OpenAI
+	p, err := chatgpt.NewProvider(conf)
+	if err != nil {
+		logger.Error("NewProvider failed",
+			"error", err,
+		)
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	models, err := provider.Models(ctx, p)
+	if errors.Is(err, provider.ErrModelsUnsupported) {
+		err = nil
+	}
+	if err != nil {
+		logger.Error("list models failed",
+			"error", err,
+		)
+	}
+	if len(models) > 0 && !slices.Contains(models, cfg.Model) {
+		models = append([]string{cfg.Model}, models...)
+	}
+	slices.Sort(models)
+	return models, err
+}
@@ -16,14 +16,19 @@ package chat
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"sync"
 
-	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/lenye/aichat/internal/chatgpt"
 	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/internal/handler"
+	"github.com/lenye/aichat/pkg/requestid"
+	"github.com/lenye/aichat/pkg/tracing"
+	"github.com/lenye/aichat/pkg/web/auth"
 	"github.com/lenye/aichat/pkg/web/logging"
 	"github.com/lenye/aichat/pkg/web/render"
 	"github.com/lenye/aichat/pkg/web/templatemap"
@@ -55,7 +60,7 @@ func Message(w http.ResponseWriter, r *http.Request) {
 		in := &chatgpt.Message{
 			StreamID:  streamID,
 			ID:        "",
-			User:      "",
+			User:      auth.UserFromContext(ctx),
 			Model:     "",
 			Prompt:    prompt,
 			System:    "",
@@ -67,33 +72,78 @@ func Message(w http.ResponseWriter, r *http.Request) {
 		in.Stream, _ = strconv.ParseBool(r.PostFormValue("stream"))
 		in.Model = r.PostFormValue("model")
 		if in.Model == "" {
-			in.Model = openai.GPT3Dot5Turbo
+			in.Model = config.Default().OpenAI.Model
 		}
 		in.System = r.PostFormValue("system")
-		// if uHis, err := strconv.ParseUint(r.PostFormValue("history"), 10, 0); err != nil {
-		// 	in.History = uint(uHis)
-		// }
+		in.History = config.Default().OpenAI.History
+		if uHis, err := strconv.ParseUint(r.PostFormValue("history"), 10, 0); err == nil {
+			in.History = uint(uHis)
+		}
 		if uu, err := strconv.ParseUint(r.PostFormValue("max_tokens"), 10, 0); err == nil {
 			in.MaxTokens = uint(uu)
 		}
+		in.ContextWindow = config.Default().OpenAI.ContextWindow
+		in.GenerationID = r.PostFormValue("generation_id")
+		if in.GenerationID == "" {
+			in.GenerationID = requestid.New()
+		}
+
+		var span trace.Span
+		ctx, span = tracing.Start(ctx, "chat.Message",
+			trace.WithAttributes(
+				tracing.AttrModel.String(in.Model),
+				tracing.AttrStream.Bool(in.Stream),
+				tracing.AttrStreamID.String(in.StreamID),
+			),
+		)
+		defer span.End()
+		r = r.WithContext(ctx)
 
 		logger.Debug("input",
 			"data", in,
 		)
 
+		conv, ok := loadConversation(ctx, in)
+		if !ok {
+			handler.NotFound(w, r)
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 		flusher.Flush()
 
-		var hisMsg []openai.ChatCompletionMessage // 聊天记录
-		chatReq := chatgpt.MakeChatRequest(in, hisMsg)
+		in.Summary = conv.Summary
+		chatReq, trimmed, reqErr := chatgpt.MakeChatRequest(ctx, in, conv.Recent(in.History))
+		if !trimmed.Empty() {
+			logger.Info("history trimmed to fit the context window",
+				"model", in.Model,
+				"dropped", trimmed.Messages,
+				"truncated", trimmed.Truncated,
+				"tokens", trimmed.Tokens,
+			)
+		}
 		chStr := make(chan string)
-
-		var wg sync.WaitGroup
+		// 可以用 /chat/stop 停止的生成
+		genCtx, done := chatgpt.StartGeneration(ctx, in.StreamID, in.GenerationID, in.User)
+		defer done()
+		r = r.WithContext(genCtx)
+
+		var (
+			wg      sync.WaitGroup
+			chatErr error
+		)
 		wg.Add(1)
 		// ai chat
 		go func() {
 			defer wg.Done()
-			chatgpt.HttpChatCompletion(r, config.Default().OpenAI, chatReq, chStr)
+			if reqErr != nil {
+				// 提示语超过了上下文长度，不发送请求
+				chStr <- chatgpt.PromptTooLongNotice
+				close(chStr)
+				chatErr = reqErr
+				return
+			}
+			chatErr = chatgpt.HttpChatCompletion(r, config.Default(), chatReq, chStr)
 		}()
 		messages := chatgpt.HttpChatResponseProcess(w, r, chStr)
 		logger.Debug("ai",
@@ -101,21 +151,42 @@ func Message(w http.ResponseWriter, r *http.Request) {
 		)
 
 		wg.Wait()
+		stopped := chatgpt.Stopped(genCtx)
+		if stopped {
+			logger.Info("generation stopped",
+				"stream_id", in.StreamID,
+				"generation_id", in.GenerationID,
+			)
+			span.AddEvent("stopped")
+			_, _ = fmt.Fprint(w, "event: stopped\ndata: [[已停止]]\n\n")
+			flusher.Flush()
+		} else {
+			// 错误的类别记录在 chatgpt.HttpChatCompletion 的 span
+			tracing.Error(span, chatErr, "")
+		}
 
-		// todo 计算token，保存账户余额，保存聊天记录
+		// 保存聊天记录，停止时保存已生成的部分
+		if reqErr == nil && (chatErr == nil || stopped) && messages != "" {
+			chatgpt.SaveConversation(ctx, conv, chatReq.Messages[len(chatReq.Messages)-1], messages)
+		}
 
 		m["stream_id"] = in.StreamID
 		m["model"] = in.Model
 		m["stream"] = strconv.FormatBool(in.Stream)
 		m["system"] = in.System
 		m["history"] = strconv.FormatUint(uint64(in.History), 10)
+		m["max_tokens"] = strconv.FormatUint(uint64(in.MaxTokens), 10)
 	} else {
 		m["stream_id"] = getStreamID(w, r)
-		m["model"] = openai.GPT3Dot5Turbo
+		m["model"] = config.Default().OpenAI.Model
 		m["stream"] = "true"
 		m["system"] = ""
-		m["history"] = "0"
+		m["history"] = strconv.FormatUint(uint64(config.Default().OpenAI.History), 10)
 	}
 
+	m["models"] = availableModels(ctx)
+	// 下一次提问的生成 id
+	m["generation_id"] = requestid.New()
+
 	render.Html(w, r, "chat_input.gohtml", m)
 }
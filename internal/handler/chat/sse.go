@@ -0,0 +1,31 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chat
+
+import (
+	"net/http"
+
+	"github.com/lenye/aichat/internal/handler"
+	"github.com/lenye/aichat/pkg/web/sse"
+)
+
+// Sse 订阅会话的 sse 流，只能订阅自己的会话
+func Sse(w http.ResponseWriter, r *http.Request) {
+	if !owned(r.Context(), r.URL.Query().Get("stream")) {
+		handler.NotFound(w, r)
+		return
+	}
+	sse.Default().ServeHTTP(w, r)
+}
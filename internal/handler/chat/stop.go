@@ -0,0 +1,45 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chat
+
+import (
+	"net/http"
+
+	"github.com/lenye/aichat/internal/chatgpt"
+	"github.com/lenye/aichat/internal/handler"
+	"github.com/lenye/aichat/pkg/web/auth"
+	"github.com/lenye/aichat/pkg/web/logging"
+	"github.com/lenye/aichat/pkg/web/render"
+)
+
+// Stop 停止进行中的生成，按 stream_id 和 generation_id 查找，只能停止自己的生成。
+// 已生成的部分保留在聊天记录中，sse 流上发送 stopped 事件。
+func Stop(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	streamID := r.PostFormValue("stream_id")
+	generationID := r.PostFormValue("generation_id")
+	user := auth.UserFromContext(ctx)
+
+	if streamID == "" || generationID == "" || !chatgpt.StopGeneration(streamID, generationID, user) {
+		handler.NotFound(w, r)
+		return
+	}
+	logging.FromContext(ctx).Info("stop generation",
+		"stream_id", streamID,
+		"generation_id", generationID,
+		"user", user,
+	)
+	render.HtmlNoContent(w)
+}
@@ -41,6 +41,14 @@ func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
 		"error": http.StatusText(code)})
 }
 
+// ServiceUnavailable 停止服务的 drain 期间拒绝新的聊天
+func ServiceUnavailable(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusServiceUnavailable
+	render.HtmlStatus(w, r, code, "503.gohtml", map[string]string{
+		"title": http.StatusText(code),
+		"error": "服务器正在关闭，请稍后再试"})
+}
+
 // InternalServerError replies to the request with an HTTP 500 method not allowed error.
 func InternalServerError(w http.ResponseWriter, r *http.Request, err error) {
 	render.Html500(w, r, err)
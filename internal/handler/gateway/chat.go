@@ -0,0 +1,265 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/lenye/aichat/internal/billing"
+	"github.com/lenye/aichat/internal/chatgpt"
+	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/internal/provider"
+	"github.com/lenye/aichat/pkg/web/auth"
+	"github.com/lenye/aichat/pkg/web/logging"
+)
+
+// ChatCompletions POST /v1/chat/completions
+func ChatCompletions(w http.ResponseWriter, r *http.Request) {
+	var req openai.ChatCompletionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err), "invalid_request_error", "")
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeError(w, http.StatusBadRequest, "messages is required", "invalid_request_error", "")
+		return
+	}
+	if req.Model == "" {
+		req.Model = config.Default().OpenAI.Model
+	}
+	// 计费和额度按网关 key 的用户，不使用客户端填写的 user
+	req.User = auth.UserFromContext(r.Context())
+
+	// 客户端是否要求流模式返回用量，计费时 chatgpt.ChatCompletion 会要求上游返回用量
+	includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+	id := "chatcmpl-" + uuid.NewString()
+	var resp *provider.Response
+	notice, err := chatgpt.ChatCompletion(r.Context(), "gateway.ChatCompletions", config.Default(), &req,
+		func(ctx context.Context, p provider.Provider) (*provider.Response, error) {
+			if req.Stream {
+				return streamChat(w, r.WithContext(ctx), p, &req, id, includeUsage)
+			}
+			var err error
+			resp, err = p.CreateChat(ctx, &req)
+			return resp, err
+		})
+	if notice != "" {
+		// 没有发送请求: 余额不足或者创建提供方失败
+		writeRefused(w, r, err)
+		return
+	}
+	if req.Stream {
+		return
+	}
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &openai.ChatCompletionResponse{
+		ID:      id,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []openai.ChatCompletionChoice{{
+			Index: 0,
+			Message: openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleAssistant,
+				Content: resp.Content,
+			},
+			FinishReason: resp.FinishReason,
+		}},
+		Usage: resp.Usage,
+	})
+}
+
+// writeRefused 余额不足返回 402 insufficient_balance，额度用完返回 429 quota_exceeded，其它错误作为上游错误
+func writeRefused(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, billing.ErrInsufficientBalance):
+		writeError(w, http.StatusPaymentRequired, err.Error(), "insufficient_quota", "insufficient_balance")
+	case errors.Is(err, billing.ErrQuotaExceeded):
+		writeError(w, http.StatusTooManyRequests, err.Error(), "insufficient_quota", "quota_exceeded")
+	default:
+		writeUpstreamError(w, r, err)
+	}
+}
+
+// streamChat openai 格式的流: 每个增量一个 chat.completion.chunk，最后是 [DONE]。
+// 第一个内容之前的错误返回 http 错误，之后的错误作为 error 事件发送。
+// 返回已收到的回复和用量，用于计费。
+func streamChat(w http.ResponseWriter, r *http.Request, p provider.Provider, req *openai.ChatCompletionRequest, id string, includeUsage bool) (*provider.Response, error) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	stream, err := p.CreateChatStream(ctx, req)
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return nil, err
+	}
+	defer stream.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	created := time.Now().Unix()
+	send := func(v any) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	chunk := func(delta openai.ChatCompletionStreamChoiceDelta, finishReason openai.FinishReason) *openai.ChatCompletionStreamResponse {
+		return &openai.ChatCompletionStreamResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   req.Model,
+			Choices: []openai.ChatCompletionStreamChoice{{
+				Index:        0,
+				Delta:        delta,
+				FinishReason: finishReason,
+			}},
+		}
+	}
+
+	resp := new(provider.Response)
+	var sb strings.Builder
+	defer func() {
+		resp.Content = sb.String()
+	}()
+
+	// 第一个增量带有角色，最后一个增量带有结束原因
+	role := openai.ChatMessageRoleAssistant
+	finished := false
+	for {
+		delta, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				if !finished {
+					_ = send(chunk(openai.ChatCompletionStreamChoiceDelta{Role: role}, openai.FinishReasonStop))
+				}
+				_, _ = io.WriteString(w, "data: [DONE]\n\n")
+				if flusher != nil {
+					flusher.Flush()
+				}
+				return resp, nil
+			}
+			logger.Error("gateway read stream failed",
+				"error", err,
+			)
+			_, errResp := upstreamError(err)
+			_ = send(errResp)
+			return resp, err
+		}
+
+		if delta.FinishReason != "" {
+			resp.FinishReason = delta.FinishReason
+		}
+		if delta.Usage != nil {
+			resp.Usage = *delta.Usage
+		}
+		if delta.Model != "" {
+			resp.Model = delta.Model
+		}
+		sb.WriteString(delta.Content)
+
+		if delta.Content != "" || delta.FinishReason != "" {
+			if err := send(chunk(openai.ChatCompletionStreamChoiceDelta{
+				Role:    role,
+				Content: delta.Content,
+			}, delta.FinishReason)); err != nil {
+				logger.Error("gateway write stream failed",
+					"error", err,
+				)
+				return resp, err
+			}
+			role = ""
+			finished = delta.FinishReason != ""
+		}
+		if delta.Usage != nil && includeUsage {
+			if err := send(&openai.ChatCompletionStreamResponse{
+				ID:      id,
+				Object:  "chat.completion.chunk",
+				Created: created,
+				Model:   req.Model,
+				Choices: []openai.ChatCompletionStreamChoice{},
+				Usage:   delta.Usage,
+			}); err != nil {
+				logger.Error("gateway write stream failed",
+					"error", err,
+				)
+				return resp, err
+			}
+		}
+	}
+}
+
+// Models GET /v1/models 全部后端可用模型的并集
+func Models(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	p, err := chatgpt.NewProvider(config.Default())
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	models, err := provider.Models(ctx, p)
+	if err != nil && !errors.Is(err, provider.ErrModelsUnsupported) {
+		if len(models) == 0 {
+			writeUpstreamError(w, r, err)
+			return
+		}
+		logger.Warn("list models partially failed",
+			"error", err,
+		)
+	}
+	if len(models) == 0 {
+		models = []string{config.Default().OpenAI.Model}
+	}
+
+	list := openai.ModelsList{Models: make([]openai.Model, 0, len(models))}
+	for _, m := range models {
+		list.Models = append(list.Models, openai.Model{
+			ID:      m,
+			Object:  "model",
+			OwnedBy: "aichat",
+		})
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Object string `json:"object"`
+		openai.ModelsList
+	}{Object: "list", ModelsList: list})
+}
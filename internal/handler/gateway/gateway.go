@@ -0,0 +1,111 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gateway 兼容 OpenAI api 的网关
+//
+// 客户端使用网关签发的 key，由网关使用真正的 api key、代理和后端路由访问上游。
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/lenye/aichat/internal/chatgpt"
+	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/pkg/web/auth"
+	"github.com/lenye/aichat/pkg/web/logging"
+)
+
+// maxRequestSize 请求的最大字节数
+const maxRequestSize = 4 << 20
+
+// Auth 校验客户端的 key: Authorization: Bearer <key>，key 对应的用户作为登录的用户；没有配置 key 时网关不可用
+func Auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gw := config.Default().Gateway
+		if len(gw.Keys) == 0 {
+			writeError(w, http.StatusNotFound, "gateway is disabled", "invalid_request_error", "gateway_disabled")
+			return
+		}
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		user, ok := gw.User(strings.TrimSpace(token))
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "invalid api key", "invalid_request_error", "invalid_api_key")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(auth.WithUser(r.Context(), user)))
+	})
+}
+
+// errorResponse openai 格式的错误
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, message, typ, code string) {
+	writeJSON(w, statusCode, &errorResponse{Error: errorBody{
+		Message: message,
+		Type:    typ,
+		Code:    code,
+	}})
+}
+
+// ServiceUnavailable 停止服务的 drain 期间拒绝新的聊天
+func ServiceUnavailable(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusServiceUnavailable, "server is shutting down", "server_error", "server_shutting_down")
+}
+
+// upstreamError 上游的错误转换为 http 状态码和 openai 格式的错误
+func upstreamError(err error) (int, *errorResponse) {
+	resp := &errorResponse{Error: errorBody{
+		Message: err.Error(),
+		Type:    "upstream_error",
+	}}
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		resp.Error.Message = apiErr.Message
+		if apiErr.Type != "" {
+			resp.Error.Type = apiErr.Type
+		}
+		if code, ok := apiErr.Code.(string); ok {
+			resp.Error.Code = code
+		}
+	}
+	return chatgpt.ErrorStatus(err), resp
+}
+
+func writeUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	logging.FromContext(r.Context()).Error("gateway upstream failed",
+		"error", err,
+	)
+	statusCode, resp := upstreamError(err)
+	writeJSON(w, statusCode, resp)
+}
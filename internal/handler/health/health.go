@@ -0,0 +1,119 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package health 存活和就绪检查，供 docker、kubernetes 使用
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lenye/aichat/internal/chatgpt"
+	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/internal/provider"
+	"github.com/lenye/aichat/pkg/web/drain"
+	"github.com/lenye/aichat/pkg/web/logging"
+	"github.com/lenye/aichat/pkg/web/render"
+)
+
+// 检查结果
+const (
+	StatusOK          = "ok"
+	StatusDraining    = "draining"
+	StatusUnavailable = "unavailable"
+)
+
+// probeTTL 上游检查结果的缓存时间，避免频繁的就绪检查请求上游
+const probeTTL = 10 * time.Second
+
+// probeTimeout 上游检查的超时
+const probeTimeout = 5 * time.Second
+
+type response struct {
+	Status string `json:"status"`
+	Active int    `json:"active"`          // 进行中的聊天数
+	Error  string `json:"error,omitempty"` // 上游检查失败的错误类别，见 chatgpt.ErrorCategory
+}
+
+// Healthz 存活检查，能处理请求就返回 200
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, &response{Status: StatusOK, Active: drain.Default().Active()})
+}
+
+// Readyz 就绪检查，drain 中返回 503；web_ready_probe=true 时检查上游，上游不可用时返回 503
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	d := drain.Default()
+	if d.Draining() {
+		render.JSONStatus(w, r, http.StatusServiceUnavailable, &response{Status: StatusDraining, Active: d.Active()})
+		return
+	}
+
+	if config.Default().Web.ReadyProbe {
+		if err := probe(r.Context()); err != nil {
+			render.JSONStatus(w, r, http.StatusServiceUnavailable, &response{
+				Status: StatusUnavailable,
+				Active: d.Active(),
+				Error:  chatgpt.ErrorCategory(err),
+			})
+			return
+		}
+	}
+	render.JSON(w, r, &response{Status: StatusOK, Active: d.Active()})
+}
+
+var probeCache struct {
+	sync.Mutex
+	cfg     *config.Configuration // 重新加载配置后缓存失效
+	err     error
+	expires time.Time
+}
+
+// probe 查询上游的模型列表，不支持查询模型的后端视为可用
+func probe(ctx context.Context) error {
+	probeCache.Lock()
+	defer probeCache.Unlock()
+
+	conf := config.Default()
+	if probeCache.cfg == conf && time.Now().Before(probeCache.expires) {
+		return probeCache.err
+	}
+
+	err := probeUpstream(ctx, conf)
+	if err != nil {
+		logging.FromContext(ctx).Warn("readiness probe failed",
+			"error", err,
+		)
+	}
+	probeCache.cfg = conf
+	probeCache.err = err
+	probeCache.expires = time.Now().Add(probeTTL)
+	return err
+}
+
+func probeUpstream(ctx context.Context, conf *config.Configuration) error {
+	p, err := chatgpt.NewProvider(conf)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	if _, err := provider.Models(ctx, p); err != nil && !errors.Is(err, provider.ErrModelsUnsupported) {
+		return err
+	}
+	return nil
+}
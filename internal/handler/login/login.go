@@ -0,0 +1,108 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package login 登录页面和退出登录
+package login
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/lenye/aichat/pkg/web/auth"
+	"github.com/lenye/aichat/pkg/web/logging"
+	"github.com/lenye/aichat/pkg/web/realip"
+	"github.com/lenye/aichat/pkg/web/render"
+	"github.com/lenye/aichat/pkg/web/templatemap"
+)
+
+const (
+	// Path 登录页面
+	Path = "/login"
+	// homePath 登录后默认跳转的页面
+	homePath = "/chat"
+)
+
+// safeNext 只允许跳转到本站的路径
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return homePath
+	}
+	return next
+}
+
+// Login GET /login 登录页面，不需要登录时跳转到聊天页面
+func Login(w http.ResponseWriter, r *http.Request) {
+	next := safeNext(r.URL.Query().Get("next"))
+	a := auth.Default()
+	if !a.Enabled() {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	if _, ok := a.Sessions.User(r); ok {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	m := templatemap.FromContext(r.Context())
+	m.Title("登录")
+	m["next"] = next
+	render.Html(w, r, "login.gohtml", m)
+}
+
+// LoginPost POST /login 校验用户名和密码，成功后设置会话 cookie
+func LoginPost(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	next := safeNext(r.PostFormValue("next"))
+	a := auth.Default()
+	if !a.Enabled() {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	name := strings.TrimSpace(r.PostFormValue("user"))
+	user, ok := a.Login(name, r.PostFormValue("password"))
+	if !ok {
+		logger.Warn("login failed",
+			"user", name,
+			"ip", realip.ClientIP(r),
+		)
+		m := templatemap.FromContext(ctx)
+		m.Title("登录")
+		m["next"] = next
+		m["login_user"] = name
+		m["error"] = "用户名或密码错误"
+		render.HtmlStatus(w, r, http.StatusUnauthorized, "login.gohtml", m)
+		return
+	}
+
+	logger.Info("login",
+		"user", user,
+		"ip", realip.ClientIP(r),
+	)
+	a.Sessions.Issue(w, user)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// Logout POST /logout 删除会话 cookie，跳转到登录页面
+func Logout(w http.ResponseWriter, r *http.Request) {
+	auth.Default().Sessions.Clear(w)
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", Path)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	http.Redirect(w, r, Path, http.StatusSeeOther)
+}
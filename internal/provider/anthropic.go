@@ -0,0 +1,359 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/lenye/aichat/pkg/web/sse"
+)
+
+// https://docs.anthropic.com/en/api/messages
+const (
+	anthropicBaseURL   = "https://api.anthropic.com"
+	anthropicVersion   = "2023-06-01"
+	anthropicMaxTokens = 4096 // max_tokens 是必填项，未设置时使用的值
+
+	// anthropicMaxEventSize 流模式中单个事件的最大字节数
+	anthropicMaxEventSize = 1 << 20
+)
+
+// anthropic Anthropic Messages API
+type anthropic struct {
+	apiKey     string
+	baseURL    string
+	httpClient *http.Client
+}
+
+func newAnthropic(cfg Config, httpClient *http.Client) *anthropic {
+	baseURL := strings.TrimRight(cfg.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = anthropicBaseURL
+	}
+	return &anthropic{
+		apiKey:     cfg.APIKey,
+		baseURL:    baseURL,
+		httpClient: httpClient,
+	}
+}
+
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	System        string             `json:"system,omitempty"`
+	Messages      []anthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	Temperature   *float32           `json:"temperature,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+	Metadata      *anthropicMetadata `json:"metadata,omitempty"`
+}
+
+type anthropicMetadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string         `json:"stop_reason"`
+	Usage      anthropicUsage `json:"usage"`
+}
+
+type anthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// anthropicRequestFrom 转换请求：系统消息合并到 system，
+// 连续的相同角色的消息合并为一条，第一条消息必须是 user
+func anthropicRequestFrom(req *openai.ChatCompletionRequest, stream bool) *anthropicRequest {
+	r := &anthropicRequest{
+		Model:         req.Model,
+		MaxTokens:     req.MaxTokens,
+		StopSequences: req.Stop,
+		Stream:        stream,
+	}
+	if r.MaxTokens == 0 {
+		r.MaxTokens = anthropicMaxTokens
+	}
+	if req.Temperature > 0 {
+		// anthropic temperature 的范围是 0~1
+		t := min(req.Temperature, 1)
+		r.Temperature = &t
+	}
+	if req.User != "" {
+		r.Metadata = &anthropicMetadata{UserID: req.User}
+	}
+
+	var system []string
+	for _, msg := range req.Messages {
+		role := msg.Role
+		switch role {
+		case openai.ChatMessageRoleSystem:
+			system = append(system, msg.Content)
+			continue
+		case openai.ChatMessageRoleAssistant:
+		default:
+			role = openai.ChatMessageRoleUser
+		}
+		if n := len(r.Messages); n > 0 && r.Messages[n-1].Role == role {
+			r.Messages[n-1].Content += "\n\n" + msg.Content
+			continue
+		}
+		if len(r.Messages) == 0 && role != openai.ChatMessageRoleUser {
+			// 聊天记录被截断后可能以 assistant 开头
+			r.Messages = append(r.Messages, anthropicMessage{Role: openai.ChatMessageRoleUser, Content: "..."})
+		}
+		r.Messages = append(r.Messages, anthropicMessage{Role: role, Content: msg.Content})
+	}
+	r.System = strings.Join(system, "\n\n")
+	return r
+}
+
+// anthropicFinishReason stop_reason 转换为 openai 的 finish_reason
+func anthropicFinishReason(v string) openai.FinishReason {
+	switch v {
+	case "end_turn", "stop_sequence":
+		return openai.FinishReasonStop
+	case "max_tokens":
+		return openai.FinishReasonLength
+	case "tool_use":
+		return openai.FinishReasonToolCalls
+	case "refusal":
+		return openai.FinishReasonContentFilter
+	case "":
+		return ""
+	default:
+		return openai.FinishReason(v)
+	}
+}
+
+// anthropicAPIError 错误转换为 *openai.APIError，529 overloaded 视为 503
+func anthropicAPIError(statusCode int, e anthropicError) *openai.APIError {
+	if statusCode == 529 || e.Type == "overloaded_error" {
+		statusCode = http.StatusServiceUnavailable
+	}
+	return &openai.APIError{
+		Code:           e.Type,
+		Message:        e.Message,
+		Type:           e.Type,
+		HTTPStatus:     http.StatusText(statusCode),
+		HTTPStatusCode: statusCode,
+	}
+}
+
+func (p *anthropic) do(ctx context.Context, method, path string, body *anthropicRequest) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-api-key", p.apiKey)
+	req.Header.Set("anthropic-version", anthropicVersion)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+		if body.Stream {
+			req.Header.Set("Accept", "text/event-stream")
+		}
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		var errResp struct {
+			Error anthropicError `json:"error"`
+		}
+		data, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(data, &errResp); err != nil || errResp.Error.Message == "" {
+			errResp.Error.Message = strings.TrimSpace(string(data))
+		}
+		return nil, anthropicAPIError(resp.StatusCode, errResp.Error)
+	}
+	return resp, nil
+}
+
+func (p *anthropic) CreateChat(ctx context.Context, req *openai.ChatCompletionRequest) (*Response, error) {
+	resp, err := p.do(ctx, http.MethodPost, "/v1/messages", anthropicRequestFrom(req, false))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var v anthropicResponse
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("decode anthropic response failed, cause: %w", err)
+	}
+	var sb strings.Builder
+	for _, c := range v.Content {
+		if c.Type == "text" {
+			sb.WriteString(c.Text)
+		}
+	}
+	return &Response{
+		Content:      sb.String(),
+		FinishReason: anthropicFinishReason(v.StopReason),
+		Usage: openai.Usage{
+			PromptTokens:     v.Usage.InputTokens,
+			CompletionTokens: v.Usage.OutputTokens,
+			TotalTokens:      v.Usage.InputTokens + v.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+func (p *anthropic) CreateChatStream(ctx context.Context, req *openai.ChatCompletionRequest) (Stream, error) {
+	resp, err := p.do(ctx, http.MethodPost, "/v1/messages", anthropicRequestFrom(req, true))
+	if err != nil {
+		return nil, err
+	}
+	return &anthropicStream{
+		body:   resp.Body,
+		reader: sse.NewEventStreamReader(resp.Body, anthropicMaxEventSize),
+	}, nil
+}
+
+// Models 可用的模型 /v1/models
+func (p *anthropic) Models(ctx context.Context) ([]string, error) {
+	resp, err := p.do(ctx, http.MethodGet, "/v1/models?limit=1000", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var v struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("decode anthropic models failed, cause: %w", err)
+	}
+	models := make([]string, 0, len(v.Data))
+	for _, m := range v.Data {
+		models = append(models, m.ID)
+	}
+	return models, nil
+}
+
+// anthropicStream 流模式的事件:
+// message_start, content_block_start, content_block_delta, content_block_stop,
+// message_delta, message_stop, ping, error
+type anthropicStream struct {
+	body   io.ReadCloser
+	reader *sse.EventStreamReader
+	usage  openai.Usage
+	done   bool
+}
+
+type anthropicEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Delta struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error anthropicError `json:"error"`
+}
+
+// parseEvent 读取事件的 event 和 data 字段
+func parseEvent(block []byte) (event string, data []byte) {
+	for _, line := range bytes.Split(block, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if v, ok := bytes.CutPrefix(line, []byte("event:")); ok {
+			event = string(bytes.TrimSpace(v))
+		} else if v, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data = append(data, bytes.TrimPrefix(v, []byte(" "))...)
+		}
+	}
+	return event, data
+}
+
+func (s *anthropicStream) Recv() (*Delta, error) {
+	for {
+		if s.done {
+			return nil, io.EOF
+		}
+		block, err := s.reader.ReadEvent()
+		if err != nil {
+			return nil, err
+		}
+		_, data := parseEvent(block)
+		if len(data) == 0 {
+			continue
+		}
+		var ev anthropicEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return nil, fmt.Errorf("decode anthropic event failed, cause: %w", err)
+		}
+
+		switch ev.Type {
+		case "message_start":
+			s.usage.PromptTokens = ev.Message.Usage.InputTokens
+		case "content_block_delta":
+			if ev.Delta.Type == "text_delta" && ev.Delta.Text != "" {
+				return &Delta{Content: ev.Delta.Text}, nil
+			}
+		case "message_delta":
+			s.usage.CompletionTokens = ev.Usage.OutputTokens
+			s.usage.TotalTokens = s.usage.PromptTokens + s.usage.CompletionTokens
+			usage := s.usage
+			return &Delta{
+				FinishReason: anthropicFinishReason(ev.Delta.StopReason),
+				Usage:        &usage,
+			}, nil
+		case "message_stop":
+			s.done = true
+		case "error":
+			return nil, anthropicAPIError(http.StatusInternalServerError, ev.Error)
+		}
+	}
+}
+
+func (s *anthropicStream) Close() error {
+	return s.body.Close()
+}
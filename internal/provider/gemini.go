@@ -0,0 +1,398 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/lenye/aichat/pkg/web/sse"
+)
+
+// https://ai.google.dev/api/generate-content
+const (
+	geminiBaseURL    = "https://generativelanguage.googleapis.com"
+	geminiAPIVersion = "/v1beta"
+
+	// geminiMaxEventSize 流模式中单个事件的最大字节数
+	geminiMaxEventSize = 1 << 20
+
+	// geminiRoleModel gemini 中 assistant 的角色名称
+	geminiRoleModel = "model"
+)
+
+// gemini Google Gemini api
+type gemini struct {
+	apiKey     string
+	baseURL    string
+	httpClient *http.Client
+}
+
+func newGemini(cfg Config, httpClient *http.Client) *gemini {
+	baseURL := strings.TrimRight(cfg.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = geminiBaseURL
+	}
+	return &gemini{
+		apiKey:     cfg.APIKey,
+		baseURL:    baseURL,
+		httpClient: httpClient,
+	}
+}
+
+type geminiPart struct {
+	Text string `json:"text"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiGenerationConfig struct {
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	Temperature     *float32 `json:"temperature,omitempty"`
+	TopP            *float32 `json:"topP,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+}
+
+type geminiRequest struct {
+	Contents          []geminiContent         `json:"contents"`
+	SystemInstruction *geminiContent          `json:"systemInstruction,omitempty"`
+	GenerationConfig  *geminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type geminiUsage struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+// geminiResponse 非流模式的回复，也是流模式的每个事件
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	PromptFeedback *struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	UsageMetadata *geminiUsage `json:"usageMetadata"`
+}
+
+type geminiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+// geminiRequestFrom 转换请求：系统消息合并到 systemInstruction，assistant 转换为 model，
+// 连续的相同角色的消息合并为一条，第一条消息必须是 user
+func geminiRequestFrom(req *openai.ChatCompletionRequest) *geminiRequest {
+	r := &geminiRequest{
+		GenerationConfig: &geminiGenerationConfig{
+			MaxOutputTokens: req.MaxTokens,
+			StopSequences:   req.Stop,
+		},
+	}
+	if req.Temperature > 0 {
+		t := req.Temperature
+		r.GenerationConfig.Temperature = &t
+	}
+	if req.TopP > 0 {
+		t := req.TopP
+		r.GenerationConfig.TopP = &t
+	}
+
+	var system []geminiPart
+	for _, msg := range req.Messages {
+		var role string
+		switch msg.Role {
+		case openai.ChatMessageRoleSystem:
+			system = append(system, geminiPart{Text: msg.Content})
+			continue
+		case openai.ChatMessageRoleAssistant:
+			role = geminiRoleModel
+		default:
+			role = openai.ChatMessageRoleUser
+		}
+		if n := len(r.Contents); n > 0 && r.Contents[n-1].Role == role {
+			r.Contents[n-1].Parts = append(r.Contents[n-1].Parts, geminiPart{Text: msg.Content})
+			continue
+		}
+		if len(r.Contents) == 0 && role != openai.ChatMessageRoleUser {
+			// 聊天记录被截断后可能以 assistant 开头
+			r.Contents = append(r.Contents, geminiContent{Role: openai.ChatMessageRoleUser, Parts: []geminiPart{{Text: "..."}}})
+		}
+		r.Contents = append(r.Contents, geminiContent{Role: role, Parts: []geminiPart{{Text: msg.Content}}})
+	}
+	if len(system) > 0 {
+		r.SystemInstruction = &geminiContent{Parts: system}
+	}
+	return r
+}
+
+// geminiFinishReason finishReason 转换为 openai 的 finish_reason
+func geminiFinishReason(v string) openai.FinishReason {
+	switch v {
+	case "STOP":
+		return openai.FinishReasonStop
+	case "MAX_TOKENS":
+		return openai.FinishReasonLength
+	case "":
+		return ""
+	default:
+		return openai.FinishReason(strings.ToLower(v))
+	}
+}
+
+// geminiBlocked 内容被安全策略拦截的原因
+func geminiBlocked(finishReason string) bool {
+	switch finishReason {
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return true
+	}
+	return false
+}
+
+// geminiAPIError 错误转换为 *openai.APIError
+func geminiAPIError(statusCode int, e geminiError) *openai.APIError {
+	return &openai.APIError{
+		Code:           e.Status,
+		Message:        e.Message,
+		Type:           e.Status,
+		HTTPStatus:     http.StatusText(statusCode),
+		HTTPStatusCode: statusCode,
+	}
+}
+
+// geminiBlockedError 被安全策略拦截视为错误请求，与 openai 的 content filtering 一致
+func geminiBlockedError(reason string) *openai.APIError {
+	return &openai.APIError{
+		Code:           string(openai.FinishReasonContentFilter),
+		Message:        fmt.Sprintf("blocked by gemini safety filter: %s", reason),
+		Type:           "content_filter",
+		HTTPStatus:     http.StatusText(http.StatusBadRequest),
+		HTTPStatusCode: http.StatusBadRequest,
+	}
+}
+
+// check 检查回复是否被拦截
+func (r *geminiResponse) check() error {
+	if r.PromptFeedback != nil && r.PromptFeedback.BlockReason != "" {
+		return geminiBlockedError(r.PromptFeedback.BlockReason)
+	}
+	for _, c := range r.Candidates {
+		if geminiBlocked(c.FinishReason) {
+			return geminiBlockedError(c.FinishReason)
+		}
+	}
+	return nil
+}
+
+func (r *geminiResponse) text() string {
+	var sb strings.Builder
+	for _, c := range r.Candidates {
+		for _, part := range c.Content.Parts {
+			sb.WriteString(part.Text)
+		}
+	}
+	return sb.String()
+}
+
+func (r *geminiResponse) finishReason() openai.FinishReason {
+	for _, c := range r.Candidates {
+		if c.FinishReason != "" {
+			return geminiFinishReason(c.FinishReason)
+		}
+	}
+	return ""
+}
+
+func (r *geminiResponse) usage() *openai.Usage {
+	if r.UsageMetadata == nil {
+		return nil
+	}
+	return &openai.Usage{
+		PromptTokens:     r.UsageMetadata.PromptTokenCount,
+		CompletionTokens: r.UsageMetadata.CandidatesTokenCount,
+		TotalTokens:      r.UsageMetadata.TotalTokenCount,
+	}
+}
+
+func (p *gemini) do(ctx context.Context, method, path string, body *geminiRequest) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+geminiAPIVersion+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-goog-api-key", p.apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		var errResp struct {
+			Error geminiError `json:"error"`
+		}
+		data, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(data, &errResp); err != nil || errResp.Error.Message == "" {
+			errResp.Error.Message = strings.TrimSpace(string(data))
+		}
+		return nil, geminiAPIError(resp.StatusCode, errResp.Error)
+	}
+	return resp, nil
+}
+
+// geminiModelPath 模型名称可以带或不带 models/ 前缀
+func geminiModelPath(model string) string {
+	return "/models/" + url.PathEscape(strings.TrimPrefix(model, "models/"))
+}
+
+func (p *gemini) CreateChat(ctx context.Context, req *openai.ChatCompletionRequest) (*Response, error) {
+	resp, err := p.do(ctx, http.MethodPost, geminiModelPath(req.Model)+":generateContent", geminiRequestFrom(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var v geminiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("decode gemini response failed, cause: %w", err)
+	}
+	if err := v.check(); err != nil {
+		return nil, err
+	}
+	r := &Response{
+		Content:      v.text(),
+		FinishReason: v.finishReason(),
+	}
+	if usage := v.usage(); usage != nil {
+		r.Usage = *usage
+	}
+	return r, nil
+}
+
+func (p *gemini) CreateChatStream(ctx context.Context, req *openai.ChatCompletionRequest) (Stream, error) {
+	resp, err := p.do(ctx, http.MethodPost, geminiModelPath(req.Model)+":streamGenerateContent?alt=sse", geminiRequestFrom(req))
+	if err != nil {
+		return nil, err
+	}
+	return &geminiStream{
+		body:   resp.Body,
+		reader: sse.NewEventStreamReader(resp.Body, geminiMaxEventSize),
+	}, nil
+}
+
+// Models 支持 generateContent 的模型 /models
+func (p *gemini) Models(ctx context.Context) ([]string, error) {
+	resp, err := p.do(ctx, http.MethodGet, "/models?pageSize=1000", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var v struct {
+		Models []struct {
+			Name                       string   `json:"name"`
+			SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("decode gemini models failed, cause: %w", err)
+	}
+	models := make([]string, 0, len(v.Models))
+	for _, m := range v.Models {
+		for _, method := range m.SupportedGenerationMethods {
+			if method == "generateContent" {
+				models = append(models, strings.TrimPrefix(m.Name, "models/"))
+				break
+			}
+		}
+	}
+	return models, nil
+}
+
+// geminiStream 流模式 (alt=sse) 每个事件是一个完整的 geminiResponse，
+// 最后一个事件带有 finishReason 和 usageMetadata，之后连接关闭
+type geminiStream struct {
+	body   io.ReadCloser
+	reader *sse.EventStreamReader
+}
+
+func (s *geminiStream) Recv() (*Delta, error) {
+	for {
+		block, err := s.reader.ReadEvent()
+		if err != nil {
+			return nil, err
+		}
+		_, data := parseEvent(block)
+		if len(data) == 0 {
+			continue
+		}
+		var v struct {
+			geminiResponse
+			Error *geminiError `json:"error"`
+		}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("decode gemini event failed, cause: %w", err)
+		}
+		if v.Error != nil {
+			code := v.Error.Code
+			if code == 0 {
+				code = http.StatusInternalServerError
+			}
+			return nil, geminiAPIError(code, *v.Error)
+		}
+		if err := v.check(); err != nil {
+			return nil, err
+		}
+
+		delta := &Delta{
+			Content:      v.text(),
+			FinishReason: v.finishReason(),
+		}
+		if delta.FinishReason != "" {
+			delta.Usage = v.usage()
+		}
+		if delta.Content != "" || delta.FinishReason != "" {
+			return delta, nil
+		}
+	}
+}
+
+func (s *geminiStream) Close() error {
+	return s.body.Close()
+}
@@ -0,0 +1,185 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// newGeminiStandIn 本地的 gemini api，记录收到的请求
+func newGeminiStandIn(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, body *geminiRequest)) Provider {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("x-goog-api-key"); got != "test-key" {
+			t.Errorf("x-goog-api-key = %q, want %q", got, "test-key")
+		}
+		var body geminiRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		handler(w, r, &body)
+	}))
+	t.Cleanup(srv.Close)
+
+	p, err := New(Config{Type: APITypeGemini, APIKey: "test-key", BaseURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func geminiChatRequest(stream bool) *openai.ChatCompletionRequest {
+	return &openai.ChatCompletionRequest{
+		Model:     "gemini-1.5-flash",
+		MaxTokens: 100,
+		Stream:    stream,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: "be brief"},
+			{Role: openai.ChatMessageRoleUser, Content: "hi"},
+			{Role: openai.ChatMessageRoleAssistant, Content: "hello"},
+			{Role: openai.ChatMessageRoleUser, Content: "how are you"},
+		},
+	}
+}
+
+func TestGeminiCreateChat(t *testing.T) {
+	p := newGeminiStandIn(t, func(w http.ResponseWriter, r *http.Request, body *geminiRequest) {
+		if want := "/v1beta/models/gemini-1.5-flash:generateContent"; r.URL.Path != want {
+			t.Errorf("path = %q, want %q", r.URL.Path, want)
+		}
+		if body.SystemInstruction == nil || len(body.SystemInstruction.Parts) != 1 || body.SystemInstruction.Parts[0].Text != "be brief" {
+			t.Errorf("systemInstruction = %+v, want the system message", body.SystemInstruction)
+		}
+		var roles []string
+		for _, c := range body.Contents {
+			roles = append(roles, c.Role)
+		}
+		if got, want := fmt.Sprint(roles), "[user model user]"; got != want {
+			t.Errorf("roles = %s, want %s", got, want)
+		}
+		if body.GenerationConfig == nil || body.GenerationConfig.MaxOutputTokens != 100 {
+			t.Errorf("generationConfig = %+v, want maxOutputTokens 100", body.GenerationConfig)
+		}
+		_, _ = io.WriteString(w, `{"candidates":[{"content":{"role":"model","parts":[{"text":"fine"}]},"finishReason":"STOP"}],
+			"usageMetadata":{"promptTokenCount":7,"candidatesTokenCount":1,"totalTokenCount":8}}`)
+	})
+
+	resp, err := p.CreateChat(context.Background(), geminiChatRequest(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "fine" || resp.FinishReason != openai.FinishReasonStop {
+		t.Errorf("response = %q, %q; want %q, %q", resp.Content, resp.FinishReason, "fine", openai.FinishReasonStop)
+	}
+	if resp.Usage.PromptTokens != 7 || resp.Usage.CompletionTokens != 1 {
+		t.Errorf("usage = %+v, want 7 prompt and 1 completion tokens", resp.Usage)
+	}
+}
+
+func TestGeminiCreateChatStream(t *testing.T) {
+	p := newGeminiStandIn(t, func(w http.ResponseWriter, r *http.Request, body *geminiRequest) {
+		if want := "/v1beta/models/gemini-1.5-flash:streamGenerateContent"; r.URL.Path != want {
+			t.Errorf("path = %q, want %q", r.URL.Path, want)
+		}
+		if got := r.URL.Query().Get("alt"); got != "sse" {
+			t.Errorf("alt = %q, want sse", got)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"I am \"}]}}]}\r\n\r\n")
+		_, _ = io.WriteString(w, "data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"fine\"}]},\"finishReason\":\"MAX_TOKENS\"}],"+
+			"\"usageMetadata\":{\"promptTokenCount\":7,\"candidatesTokenCount\":3,\"totalTokenCount\":10}}\r\n\r\n")
+	})
+
+	stream, err := p.CreateChatStream(context.Background(), geminiChatRequest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	var (
+		content string
+		last    *Delta
+	)
+	for {
+		delta, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content += delta.Content
+		last = delta
+	}
+	if content != "I am fine" {
+		t.Errorf("content = %q, want %q", content, "I am fine")
+	}
+	if last == nil || last.FinishReason != openai.FinishReasonLength {
+		t.Fatalf("last delta = %+v, want finish reason %q", last, openai.FinishReasonLength)
+	}
+	if last.Usage == nil || last.Usage.CompletionTokens != 3 {
+		t.Errorf("usage = %+v, want 3 completion tokens", last.Usage)
+	}
+}
+
+func TestGeminiSafetyBlock(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream bool
+		body   string
+	}{
+		{"prompt blocked", false, `{"promptFeedback":{"blockReason":"SAFETY"}}`},
+		{"candidate blocked", false, `{"candidates":[{"content":{"parts":[]},"finishReason":"SAFETY"}]}`},
+		{"stream blocked", true, "data: {\"candidates\":[{\"content\":{\"parts\":[]},\"finishReason\":\"SAFETY\"}]}\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newGeminiStandIn(t, func(w http.ResponseWriter, r *http.Request, body *geminiRequest) {
+				_, _ = io.WriteString(w, tt.body)
+			})
+
+			var err error
+			if tt.stream {
+				var stream Stream
+				stream, err = p.CreateChatStream(context.Background(), geminiChatRequest(true))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer stream.Close()
+				_, err = stream.Recv()
+			} else {
+				_, err = p.CreateChat(context.Background(), geminiChatRequest(false))
+			}
+
+			// chatErr 把 400 的 *openai.APIError 显示为 [[错误请求]]
+			var apiErr *openai.APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("error = %v, want *openai.APIError", err)
+			}
+			if apiErr.HTTPStatusCode != http.StatusBadRequest || apiErr.Code != string(openai.FinishReasonContentFilter) {
+				t.Errorf("error = %d %v, want %d %q", apiErr.HTTPStatusCode, apiErr.Code, http.StatusBadRequest, openai.FinishReasonContentFilter)
+			}
+		})
+	}
+}
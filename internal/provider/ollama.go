@@ -0,0 +1,287 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// https://github.com/ollama/ollama/blob/main/docs/api.md
+const (
+	ollamaBaseURL = "http://localhost:11434"
+
+	// ollamaMaxLineSize 流模式中单行的最大字节数
+	ollamaMaxLineSize = 1 << 20
+)
+
+// ollama Ollama 原生 api
+type ollama struct {
+	apiKey     string
+	baseURL    string
+	keepAlive  string
+	numCtx     int
+	httpClient *http.Client
+}
+
+func newOllama(cfg Config, httpClient *http.Client) *ollama {
+	baseURL := strings.TrimRight(cfg.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = ollamaBaseURL
+	}
+	return &ollama{
+		apiKey:     cfg.APIKey,
+		baseURL:    baseURL,
+		keepAlive:  cfg.KeepAlive,
+		numCtx:     cfg.NumCtx,
+		httpClient: httpClient,
+	}
+}
+
+type ollamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ollamaOptions struct {
+	NumCtx      int      `json:"num_ctx,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+type ollamaRequest struct {
+	Model     string          `json:"model"`
+	Messages  []ollamaMessage `json:"messages"`
+	Stream    bool            `json:"stream"`
+	KeepAlive string          `json:"keep_alive,omitempty"`
+	Options   *ollamaOptions  `json:"options,omitempty"`
+}
+
+// ollamaResponse 非流模式的回复，也是流模式的每一行
+type ollamaResponse struct {
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+func (p *ollama) requestFrom(req *openai.ChatCompletionRequest, stream bool) *ollamaRequest {
+	r := &ollamaRequest{
+		Model:     req.Model,
+		Stream:    stream,
+		KeepAlive: p.keepAlive,
+		Options: &ollamaOptions{
+			NumCtx:     p.numCtx,
+			NumPredict: req.MaxTokens,
+			Stop:       req.Stop,
+		},
+	}
+	if req.Temperature > 0 {
+		t := req.Temperature
+		r.Options.Temperature = &t
+	}
+	if req.TopP > 0 {
+		t := req.TopP
+		r.Options.TopP = &t
+	}
+	for _, msg := range req.Messages {
+		r.Messages = append(r.Messages, ollamaMessage{Role: msg.Role, Content: msg.Content})
+	}
+	return r
+}
+
+func ollamaFinishReason(v string) openai.FinishReason {
+	switch v {
+	case "stop", "":
+		return openai.FinishReasonStop
+	case "length":
+		return openai.FinishReasonLength
+	default:
+		return openai.FinishReason(v)
+	}
+}
+
+func (r *ollamaResponse) usage() openai.Usage {
+	return openai.Usage{
+		PromptTokens:     r.PromptEvalCount,
+		CompletionTokens: r.EvalCount,
+		TotalTokens:      r.PromptEvalCount + r.EvalCount,
+	}
+}
+
+// ollamaAPIError 错误转换为 *openai.APIError
+func ollamaAPIError(statusCode int, message string) *openai.APIError {
+	return &openai.APIError{
+		Message:        message,
+		Type:           "ollama_error",
+		HTTPStatus:     http.StatusText(statusCode),
+		HTTPStatusCode: statusCode,
+	}
+}
+
+func (p *ollama) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if p.apiKey != "" {
+		// ollama 本身不校验，便于经过需要鉴权的反向代理
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		var errResp ollamaResponse
+		data, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(data, &errResp); err != nil || errResp.Error == "" {
+			errResp.Error = strings.TrimSpace(string(data))
+		}
+		return nil, ollamaAPIError(resp.StatusCode, errResp.Error)
+	}
+	return resp, nil
+}
+
+func (p *ollama) CreateChat(ctx context.Context, req *openai.ChatCompletionRequest) (*Response, error) {
+	resp, err := p.do(ctx, http.MethodPost, "/api/chat", p.requestFrom(req, false))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var v ollamaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("decode ollama response failed, cause: %w", err)
+	}
+	if v.Error != "" {
+		return nil, ollamaAPIError(http.StatusInternalServerError, v.Error)
+	}
+	return &Response{
+		Content:      v.Message.Content,
+		FinishReason: ollamaFinishReason(v.DoneReason),
+		Usage:        v.usage(),
+	}, nil
+}
+
+func (p *ollama) CreateChatStream(ctx context.Context, req *openai.ChatCompletionRequest) (Stream, error) {
+	resp, err := p.do(ctx, http.MethodPost, "/api/chat", p.requestFrom(req, true))
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 4096), ollamaMaxLineSize)
+	return &ollamaStream{
+		body:    resp.Body,
+		scanner: scanner,
+	}, nil
+}
+
+// Models 已安装的模型 /api/tags
+func (p *ollama) Models(ctx context.Context) ([]string, error) {
+	resp, err := p.do(ctx, http.MethodGet, "/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var v struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("decode ollama tags failed, cause: %w", err)
+	}
+	models := make([]string, 0, len(v.Models))
+	for _, m := range v.Models {
+		models = append(models, m.Name)
+	}
+	return models, nil
+}
+
+// ollamaStream 流模式每行一个 json (NDJSON)，最后一行 done=true
+type ollamaStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+	done    bool
+}
+
+func (s *ollamaStream) Recv() (*Delta, error) {
+	for {
+		if s.done {
+			return nil, io.EOF
+		}
+		if !s.scanner.Scan() {
+			if err := s.scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("ollama stream closed before done")
+		}
+		line := bytes.TrimSpace(s.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var v ollamaResponse
+		if err := json.Unmarshal(line, &v); err != nil {
+			return nil, fmt.Errorf("decode ollama stream failed, cause: %w", err)
+		}
+		if v.Error != "" {
+			return nil, ollamaAPIError(http.StatusInternalServerError, v.Error)
+		}
+		if v.Done {
+			s.done = true
+			usage := v.usage()
+			return &Delta{
+				Content:      v.Message.Content,
+				FinishReason: ollamaFinishReason(v.DoneReason),
+				Usage:        &usage,
+			}, nil
+		}
+		if v.Message.Content != "" {
+			return &Delta{Content: v.Message.Content}, nil
+		}
+	}
+}
+
+func (s *ollamaStream) Close() error {
+	return s.body.Close()
+}
@@ -0,0 +1,110 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// openAI OpenAI 和 Azure OpenAI
+type openAI struct {
+	client *openai.Client
+}
+
+func newOpenAI(cfg Config, httpClient *http.Client) (*openAI, error) {
+	var c openai.ClientConfig
+	switch strings.ToUpper(cfg.Type) {
+	case APITypeAzure:
+		if cfg.BaseURL == "" {
+			return nil, errors.New("missed base url")
+		}
+		c = openai.DefaultAzureConfig(cfg.APIKey, cfg.BaseURL)
+	default:
+		c = openai.DefaultConfig(cfg.APIKey)
+		if cfg.BaseURL != "" {
+			c.BaseURL = cfg.BaseURL
+		}
+	}
+	c.HTTPClient = httpClient
+	return &openAI{client: openai.NewClientWithConfig(c)}, nil
+}
+
+func (p *openAI) CreateChat(ctx context.Context, req *openai.ChatCompletionRequest) (*Response, error) {
+	r := *req
+	r.Stream = false
+	resp, err := p.client.CreateChatCompletion(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, errors.New("no choices in the response")
+	}
+	return &Response{
+		Content:      resp.Choices[0].Message.Content,
+		FinishReason: resp.Choices[0].FinishReason,
+		Usage:        resp.Usage,
+	}, nil
+}
+
+func (p *openAI) CreateChatStream(ctx context.Context, req *openai.ChatCompletionRequest) (Stream, error) {
+	r := *req
+	r.Stream = true
+	stream, err := p.client.CreateChatCompletionStream(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return &openAIStream{stream: stream}, nil
+}
+
+// Models 可用的模型 /models
+func (p *openAI) Models(ctx context.Context) ([]string, error) {
+	list, err := p.client.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	models := make([]string, 0, len(list.Models))
+	for _, m := range list.Models {
+		models = append(models, m.ID)
+	}
+	return models, nil
+}
+
+type openAIStream struct {
+	stream *openai.ChatCompletionStream
+}
+
+func (s *openAIStream) Recv() (*Delta, error) {
+	resp, err := s.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	delta := &Delta{Usage: resp.Usage}
+	for _, choice := range resp.Choices {
+		delta.Content += choice.Delta.Content
+		if choice.FinishReason != "" {
+			delta.FinishReason = choice.FinishReason
+		}
+	}
+	return delta, nil
+}
+
+func (s *openAIStream) Close() error {
+	return s.stream.Close()
+}
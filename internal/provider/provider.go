@@ -0,0 +1,170 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package provider 聊天服务提供方的抽象
+//
+// 请求统一使用 openai.ChatCompletionRequest 描述，错误统一映射为 *openai.APIError，
+// 各个提供方负责转换为自己的协议。
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+const (
+	Timeout = 180 * time.Second
+)
+
+// api 类型
+const (
+	APITypeOpenAI    = string(openai.APITypeOpenAI)
+	APITypeAzure     = string(openai.APITypeAzure)
+	APITypeAnthropic = "ANTHROPIC"
+	APITypeOllama    = "OLLAMA"
+	APITypeGemini    = "GEMINI"
+)
+
+// ValidAPIType api 类型是否支持，不区分大小写
+func ValidAPIType(apiType string) bool {
+	switch strings.ToUpper(apiType) {
+	case APITypeOpenAI, APITypeAzure, APITypeAnthropic, APITypeOllama, APITypeGemini:
+		return true
+	}
+	return false
+}
+
+// Delta 流模式的一个增量
+type Delta struct {
+	Content      string              // 增量内容
+	FinishReason openai.FinishReason // 结束原因，只在最后出现
+	Usage        *openai.Usage       // tokens 用量，只在最后出现
+	Model        string              // 实际使用的模型，换用备用后端时与请求的模型不同
+}
+
+// Response 非流模式的回复
+type Response struct {
+	Content      string
+	FinishReason openai.FinishReason
+	Usage        openai.Usage
+	Model        string // 实际使用的模型，换用备用后端时与请求的模型不同
+}
+
+// Stream 流模式的回复，Recv 在结束时返回 io.EOF
+type Stream interface {
+	Recv() (*Delta, error)
+	Close() error
+}
+
+// Provider 聊天服务提供方
+type Provider interface {
+	// CreateChat 非流模式
+	CreateChat(ctx context.Context, req *openai.ChatCompletionRequest) (*Response, error)
+	// CreateChatStream 流模式
+	CreateChatStream(ctx context.Context, req *openai.ChatCompletionRequest) (Stream, error)
+}
+
+// ErrModelsUnsupported 提供方不支持查询模型列表
+var ErrModelsUnsupported = errors.New("model listing is not supported")
+
+// ModelLister 可以查询可用模型的提供方
+type ModelLister interface {
+	Models(ctx context.Context) ([]string, error)
+}
+
+// Models 查询提供方的可用模型
+func Models(ctx context.Context, p Provider) ([]string, error) {
+	if v, ok := p.(ModelLister); ok {
+		return v.Models(ctx)
+	}
+	return nil, ErrModelsUnsupported
+}
+
+// Config 提供方配置
+type Config struct {
+	Type    string // api 类型
+	APIKey  string
+	BaseURL string
+	Proxy   string
+
+	// ollama
+	KeepAlive string // 模型在内存中保留的时间，如 5m, -1
+	NumCtx    int    // 上下文长度
+}
+
+// RequiresAPIKey api 类型是否必须设置 api key
+func RequiresAPIKey(apiType string) bool {
+	return strings.ToUpper(apiType) != APITypeOllama
+}
+
+// New 创建提供方
+func New(cfg Config) (Provider, error) {
+	if cfg.APIKey == "" && RequiresAPIKey(cfg.Type) {
+		return nil, errors.New("missed api key")
+	}
+	if cfg.BaseURL != "" {
+		if _, err := url.Parse(cfg.BaseURL); err != nil {
+			return nil, fmt.Errorf("invalid base url: %q, cause %s", cfg.BaseURL, err)
+		}
+	}
+	httpClient, err := newHTTPClient(cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToUpper(cfg.Type) {
+	case APITypeOpenAI, APITypeAzure:
+		return newOpenAI(cfg, httpClient)
+	case APITypeAnthropic:
+		return newAnthropic(cfg, httpClient), nil
+	case APITypeOllama:
+		return newOllama(cfg, httpClient), nil
+	case APITypeGemini:
+		return newGemini(cfg, httpClient), nil
+	default:
+		return nil, fmt.Errorf("invalid api type: %q", cfg.Type)
+	}
+}
+
+// transports 按代理共享的 http.RoundTripper，提供方每次请求时创建，连接在请求之间复用
+var transports sync.Map // proxy -> http.RoundTripper
+
+// newHTTPClient 使用代理 proxy 的 http.Client，相同代理的提供方共享连接池；请求带有 span 和 traceparent
+func newHTTPClient(proxy string) (*http.Client, error) {
+	if v, ok := transports.Load(proxy); ok {
+		return &http.Client{Timeout: Timeout, Transport: v.(http.RoundTripper)}, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != "" {
+		proxyUrl, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %q, cause %s", proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	v, _ := transports.LoadOrStore(proxy, otelhttp.NewTransport(&hintTransport{base: transport}))
+	return &http.Client{
+		Timeout:   Timeout,
+		Transport: v.(http.RoundTripper),
+	}, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	retryBaseDelay = 500 * time.Millisecond // 第一次重试前的等待时间
+	retryMaxDelay  = 30 * time.Second       // 单次等待的最长时间
+)
+
+// Retry 重试配置，MaxAttempts<=1 时不重试
+type Retry struct {
+	MaxAttempts int           // 每个后端最多尝试的次数，包括第一次
+	Deadline    time.Duration // 从第一次请求开始，超过该时间不再重试，0=不限制
+}
+
+// RetryNotify 重试之前的通知，attempt 是即将开始的第几次尝试
+type RetryNotify func(backend string, attempt int, wait time.Duration, err error)
+
+type retryNotifyKey struct{}
+
+// WithRetryNotify 设置重试通知
+func WithRetryNotify(ctx context.Context, fn RetryNotify) context.Context {
+	return context.WithValue(ctx, retryNotifyKey{}, fn)
+}
+
+func retryNotifyFrom(ctx context.Context) RetryNotify {
+	fn, _ := ctx.Value(retryNotifyKey{}).(RetryNotify)
+	return fn
+}
+
+// retryable 是否是可以重试的临时错误: 429, 500, 502, 503, 504 和超时
+func retryable(err error) bool {
+	var (
+		apiErr *openai.APIError
+		reqErr *openai.RequestError
+		urlErr *url.Error
+	)
+	if errors.As(err, &apiErr) {
+		return retryableStatus(apiErr.HTTPStatusCode)
+	}
+	if errors.As(err, &reqErr) {
+		return retryableStatus(reqErr.HTTPStatusCode)
+	}
+	if errors.As(err, &urlErr) {
+		return urlErr.Timeout()
+	}
+	return false
+}
+
+func retryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff 第 n 次重试的等待时间，指数增长，随机抖动在 [d/2, d) 之间
+func backoff(n int) time.Duration {
+	d := retryBaseDelay << (n - 1)
+	if d <= 0 || d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return d/2 + rand.N(d/2)
+}
+
+// retryHint 上游要求的等待时间，由 hintTransport 从错误响应的头部读取
+type retryHint struct {
+	mu    sync.Mutex
+	after time.Duration
+}
+
+func (h *retryHint) get() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.after
+}
+
+type retryHintKey struct{}
+
+func withRetryHint(ctx context.Context) (context.Context, *retryHint) {
+	h := new(retryHint)
+	return context.WithValue(ctx, retryHintKey{}, h), h
+}
+
+// hintTransport 记录可以重试的错误响应中的 Retry-After, x-ratelimit-reset-*
+type hintTransport struct {
+	base http.RoundTripper
+}
+
+func (t *hintTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || !retryableStatus(resp.StatusCode) {
+		return resp, err
+	}
+	if h, ok := req.Context().Value(retryHintKey{}).(*retryHint); ok {
+		if after := retryAfter(resp.Header, time.Now()); after > 0 {
+			h.mu.Lock()
+			h.after = after
+			h.mu.Unlock()
+		}
+	}
+	return resp, err
+}
+
+// retryAfter 上游要求的等待时间
+//
+// Retry-After 是秒数或 http 时间；x-ratelimit-reset-requests, x-ratelimit-reset-tokens
+// 是 openai 的格式，如 1s, 6m0s, 20ms，取最大值。
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	if v := header.Get("Retry-After"); v != "" {
+		if sec, err := strconv.ParseFloat(v, 64); err == nil {
+			return time.Duration(sec * float64(time.Second))
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return t.Sub(now)
+		}
+	}
+	var after time.Duration
+	for key, values := range header {
+		if !strings.HasPrefix(strings.ToLower(key), "x-ratelimit-reset") || len(values) == 0 {
+			continue
+		}
+		if d, err := time.ParseDuration(values[0]); err == nil && d > after {
+			after = d
+		}
+	}
+	return after
+}
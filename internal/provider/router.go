@@ -0,0 +1,404 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/lenye/aichat/pkg/web/logging"
+)
+
+// Backend 命名的后端
+type Backend struct {
+	Name     string
+	Models   []string   // 模型名称或 glob 模式，为空时匹配所有模型
+	Fallback []Fallback // 失败时依次使用的后端
+	Provider Provider
+	Breaker  *Breaker // 熔断器，nil=不熔断
+}
+
+// Fallback 备用的后端，Model 为空时使用请求的模型
+type Fallback struct {
+	Backend string
+	Model   string
+}
+
+// ParseFallback 解析 backend 或 backend:model
+func ParseFallback(s string) Fallback {
+	name, model, _ := strings.Cut(s, ":")
+	return Fallback{Backend: name, Model: model}
+}
+
+// failover 错误是否换用下一个后端: 网络错误、超时、429 和 5xx 等上游错误，
+// 以及 401/403/404 等与后端的配置相关的错误；请求本身的错误换用后端也无济于事
+func failover(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var (
+		apiErr *openai.APIError
+		reqErr *openai.RequestError
+	)
+	if errors.As(err, &apiErr) {
+		return failoverStatus(apiErr.HTTPStatusCode)
+	}
+	if errors.As(err, &reqErr) {
+		return failoverStatus(reqErr.HTTPStatusCode)
+	}
+	return true
+}
+
+func failoverStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return false
+	}
+	return true
+}
+
+// isPattern 是否是 glob 模式
+func isPattern(model string) bool {
+	return strings.ContainsAny(model, `*?[\`)
+}
+
+// match 模型是否匹配后端的模型列表
+func (b *Backend) match(model string) bool {
+	if len(b.Models) == 0 {
+		return true
+	}
+	for _, pattern := range b.Models {
+		if ok, _ := path.Match(pattern, model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Router 按请求的模型选择后端
+//
+// 选择的顺序: 精确匹配模型名称的后端，匹配 glob 模式的后端，没有模型列表的后端，
+// 相同条件下按后端的配置顺序。
+// 后端在返回第一个内容之前出现临时错误时，先按 retry 重试，仍然失败时依次换用它的备用后端，
+// 熔断器打开的后端被跳过。
+type Router struct {
+	backends []*Backend
+	byName   map[string]*Backend
+	retry    Retry
+}
+
+// NewRouter 创建路由
+func NewRouter(retry Retry, backends ...*Backend) *Router {
+	byName := make(map[string]*Backend, len(backends))
+	for _, b := range backends {
+		byName[b.Name] = b
+	}
+	return &Router{backends: backends, byName: byName, retry: retry}
+}
+
+// Backends 全部后端
+func (r *Router) Backends() []*Backend {
+	return r.backends
+}
+
+// Route 模型对应的后端
+func (r *Router) Route(model string) (*Backend, error) {
+	for _, b := range r.backends {
+		for _, m := range b.Models {
+			if !isPattern(m) && m == model {
+				return b, nil
+			}
+		}
+	}
+	for _, b := range r.backends {
+		if len(b.Models) > 0 && b.match(model) {
+			return b, nil
+		}
+	}
+	for _, b := range r.backends {
+		if len(b.Models) == 0 {
+			return b, nil
+		}
+	}
+	return nil, &openai.APIError{
+		Code:           "model_not_found",
+		Message:        fmt.Sprintf("no backend for model: %q", model),
+		Type:           "invalid_request_error",
+		HTTPStatus:     http.StatusText(http.StatusNotFound),
+		HTTPStatusCode: http.StatusNotFound,
+	}
+}
+
+// attempt 依次尝试的后端和模型
+type attempt struct {
+	backend *Backend
+	model   string
+}
+
+// chain 模型对应的后端和它的备用后端
+func (r *Router) chain(model string) ([]attempt, error) {
+	b, err := r.Route(model)
+	if err != nil {
+		return nil, err
+	}
+	chain := []attempt{{backend: b, model: model}}
+	for _, f := range b.Fallback {
+		fb, ok := r.byName[f.Backend]
+		if !ok {
+			return nil, fmt.Errorf("backend %q: unknown fallback backend: %q", b.Name, f.Backend)
+		}
+		m := f.Model
+		if m == "" {
+			m = model
+		}
+		chain = append(chain, attempt{backend: fb, model: m})
+	}
+	return chain, nil
+}
+
+// errUnavailable 全部后端都被熔断
+func errUnavailable(model string) *openai.APIError {
+	return &openai.APIError{
+		Code:           "backend_unavailable",
+		Message:        fmt.Sprintf("all backends for model %q are unavailable", model),
+		Type:           "server_error",
+		HTTPStatus:     http.StatusText(http.StatusServiceUnavailable),
+		HTTPStatusCode: http.StatusServiceUnavailable,
+	}
+}
+
+// chatFunc 使用后端 a 完成一次请求
+type chatFunc func(ctx context.Context, a attempt, req *openai.ChatCompletionRequest) error
+
+// do 依次尝试 chain 中的后端，直到 fn 成功或者返回不需要换用后端的错误
+func (r *Router) do(ctx context.Context, req *openai.ChatCompletionRequest, fn chatFunc) error {
+	logger := logging.FromContext(ctx)
+	chain, err := r.chain(req.Model)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	var lastErr error
+	for i, a := range chain {
+		if !a.backend.Breaker.Allow() {
+			logger.Warn("backend skipped, circuit breaker is open",
+				"backend", a.backend.Name,
+				"model", a.model,
+			)
+			continue
+		}
+		err := r.try(ctx, a, req, fn, start)
+		a.backend.Breaker.Done(err)
+		if err == nil {
+			logger.Info("chat served",
+				"backend", a.backend.Name,
+				"model", a.model,
+				"attempts", i+1,
+			)
+			return nil
+		}
+		lastErr = err
+		if !failover(err) {
+			return err
+		}
+		if i < len(chain)-1 {
+			logger.Warn("backend failed, fail over to the next backend",
+				"error", err,
+				"backend", a.backend.Name,
+				"model", a.model,
+			)
+		}
+	}
+	if lastErr == nil {
+		return errUnavailable(req.Model)
+	}
+	return lastErr
+}
+
+// try 使用后端 a 完成请求，临时错误按指数退避重试，
+// 等待时间不少于上游要求的时间，超过 retry.Deadline 时不再重试
+func (r *Router) try(ctx context.Context, a attempt, req *openai.ChatCompletionRequest, fn chatFunc, start time.Time) error {
+	logger := logging.FromContext(ctx)
+	for n := 1; ; n++ {
+		hctx, hint := withRetryHint(ctx)
+		areq := *req
+		areq.Model = a.model
+		err := fn(hctx, a, &areq)
+		if err == nil || n >= r.retry.MaxAttempts || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		wait := backoff(n)
+		if after := hint.get(); after > wait {
+			wait = after
+		}
+		if r.retry.Deadline > 0 && time.Since(start)+wait > r.retry.Deadline {
+			return err
+		}
+		logger.Warn("backend failed, retry",
+			"error", err,
+			"backend", a.backend.Name,
+			"model", a.model,
+			"attempt", n+1,
+			"wait", wait,
+		)
+		if notify := retryNotifyFrom(ctx); notify != nil {
+			notify(a.backend.Name, n+1, wait, err)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (r *Router) CreateChat(ctx context.Context, req *openai.ChatCompletionRequest) (*Response, error) {
+	var resp *Response
+	err := r.do(ctx, req, func(ctx context.Context, a attempt, req *openai.ChatCompletionRequest) error {
+		var err error
+		resp, err = a.backend.Provider.CreateChat(ctx, req)
+		if err == nil && resp.Model == "" {
+			resp.Model = a.model
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// CreateChatStream 读到第一个内容之后才算成功，之后的错误不再重试或者换用后端
+func (r *Router) CreateChatStream(ctx context.Context, req *openai.ChatCompletionRequest) (Stream, error) {
+	var stream Stream
+	err := r.do(ctx, req, func(ctx context.Context, a attempt, req *openai.ChatCompletionRequest) error {
+		s, err := a.backend.Provider.CreateChatStream(ctx, req)
+		if err != nil {
+			return err
+		}
+		ps, err := peek(s, a.model)
+		if err != nil {
+			s.Close()
+			return err
+		}
+		stream = ps
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// peekedStream 已经读取了开头的增量的流，增量的 Model 为实际使用的模型
+type peekedStream struct {
+	Stream
+	model  string
+	deltas []*Delta
+	eof    bool
+}
+
+// peek 读取增量直到第一个内容、结束原因或者流结束
+func peek(s Stream, model string) (*peekedStream, error) {
+	ps := &peekedStream{Stream: s, model: model}
+	for {
+		delta, err := s.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				ps.eof = true
+				return ps, nil
+			}
+			return nil, err
+		}
+		ps.served(delta)
+		ps.deltas = append(ps.deltas, delta)
+		if delta.Content != "" || delta.FinishReason != "" {
+			return ps, nil
+		}
+	}
+}
+
+func (s *peekedStream) Recv() (*Delta, error) {
+	if len(s.deltas) > 0 {
+		d := s.deltas[0]
+		s.deltas = s.deltas[1:]
+		return d, nil
+	}
+	if s.eof {
+		return nil, io.EOF
+	}
+	delta, err := s.Stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	s.served(delta)
+	return delta, nil
+}
+
+// served 提供方没有返回模型时，使用后端的模型
+func (s *peekedStream) served(delta *Delta) {
+	if delta.Model == "" {
+		delta.Model = s.model
+	}
+}
+
+// Models 全部后端可用模型的并集
+//
+// 后端配置的模型名称都是可用的；支持查询的后端，再加上查询结果中匹配模型列表的模型。
+// 部分后端查询失败时，返回其余的模型和错误。
+func (r *Router) Models(ctx context.Context) ([]string, error) {
+	var (
+		models []string
+		errs   []error
+	)
+	for _, b := range r.backends {
+		for _, m := range b.Models {
+			if !isPattern(m) {
+				models = append(models, m)
+			}
+		}
+		list, err := Models(ctx, b.Provider)
+		if err != nil {
+			if !errors.Is(err, ErrModelsUnsupported) {
+				errs = append(errs, fmt.Errorf("backend %q: %w", b.Name, err))
+			}
+			continue
+		}
+		for _, m := range list {
+			if b.match(m) {
+				models = append(models, m)
+			}
+		}
+	}
+	slices.Sort(models)
+	models = slices.Compact(models)
+	if len(models) == 0 && len(errs) == 0 {
+		return nil, ErrModelsUnsupported
+	}
+	return models, errors.Join(errs...)
+}
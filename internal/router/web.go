@@ -18,11 +18,17 @@ import (
 	"net/http"
 
 	"github.com/lenye/aichat/assets"
+	"github.com/lenye/aichat/internal/config"
+	"github.com/lenye/aichat/internal/handler"
+	"github.com/lenye/aichat/internal/handler/api"
 	"github.com/lenye/aichat/internal/handler/chat"
+	"github.com/lenye/aichat/internal/handler/gateway"
+	"github.com/lenye/aichat/internal/handler/health"
+	"github.com/lenye/aichat/internal/handler/login"
 	"github.com/lenye/aichat/pkg/project"
 	"github.com/lenye/aichat/pkg/web/alice"
+	"github.com/lenye/aichat/pkg/web/metrics"
 	"github.com/lenye/aichat/pkg/web/middleware"
-	"github.com/lenye/aichat/pkg/web/sse"
 )
 
 func New() http.Handler {
@@ -39,14 +45,54 @@ func New() http.Handler {
 	r.Handle("GET /favicon.ico", staticChain.Then(fileServer))
 	r.Handle("GET /static/", staticChain.Then(http.StripPrefix("/static/", fileServer)))
 
+	// 登录
+	loginPipe := stdPipe.Append(middleware.TemplateMap)
+	r.Handle("GET "+login.Path, loginPipe.ThenFunc(login.Login))
+	r.Handle("POST "+login.Path, loginPipe.ThenFunc(login.LoginPost))
+	r.Handle("POST /logout", stdPipe.ThenFunc(login.Logout))
+
+	// 需要登录
+	authPipe := stdPipe.Append(middleware.Auth(login.Path))
+
 	// sse
-	r.Handle("GET /chat/sse", stdPipe.ThenFunc(sse.Default().ServeHTTP))
+	r.Handle("GET /chat/sse", authPipe.Append(middleware.RateLimitRequests("/chat/sse")).ThenFunc(chat.Sse))
 
 	// tpl
-	tplPipe := stdPipe.Append(middleware.TemplateMap)
+	tplPipe := authPipe.Append(middleware.TemplateMap)
 	r.Handle("GET /chat", tplPipe.ThenFunc(chat.Chat))
-	r.Handle("POST /chat/sse/msg", tplPipe.ThenFunc(chat.SseMessage))
-	r.Handle("POST /chat/msg", tplPipe.ThenFunc(chat.Message))
+	chatPipe := tplPipe.Append(middleware.Drain(handler.ServiceUnavailable))
+	r.Handle("POST /chat/sse/msg", chatPipe.Append(middleware.RateLimit("/chat/sse/msg")).ThenFunc(chat.SseMessage))
+	r.Handle("POST /chat/msg", chatPipe.Append(middleware.RateLimit("/chat/msg")).ThenFunc(chat.Message))
+	// 停止生成不受 drain 和限流的限制
+	r.Handle("POST /chat/stop", authPipe.ThenFunc(chat.Stop))
+
+	// json api
+	r.Handle("GET /api/v1/conversations", authPipe.ThenFunc(api.ListConversations))
+	r.Handle("POST /api/v1/conversations", authPipe.ThenFunc(api.CreateConversation))
+	r.Handle("GET /api/v1/conversations/{id}", authPipe.ThenFunc(api.GetConversation))
+	r.Handle("DELETE /api/v1/conversations/{id}", authPipe.ThenFunc(api.DeleteConversation))
+	r.Handle("POST /api/v1/conversations/{id}/messages", authPipe.Append(middleware.Drain(api.ServiceUnavailable)).ThenFunc(api.PostMessage))
+
+	// 兼容 openai api 的网关
+	apiPipe := stdPipe.Append(gateway.Auth)
+	r.Handle("POST /v1/chat/completions", apiPipe.Append(middleware.Drain(gateway.ServiceUnavailable)).ThenFunc(gateway.ChatCompletions))
+	r.Handle("GET /v1/models", apiPipe.ThenFunc(gateway.Models))
+
+	// prometheus 指标，不记录访问日志
+	r.HandleFunc("GET /metrics", serveMetrics)
+
+	// 存活和就绪检查，不需要登录，不记录访问日志
+	r.HandleFunc("GET /healthz", health.Healthz)
+	r.HandleFunc("GET /readyz", health.Readyz)
+
+	return metrics.Routes(r)
+}
 
-	return r
+// serveMetrics prometheus 指标，没有开启 web_metrics 时返回 404
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if !config.Default().Web.Metrics {
+		handler.NotFound(w, r)
+		return
+	}
+	metrics.Handler().ServeHTTP(w, r)
 }
@@ -0,0 +1,110 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package systemd systemd 的 socket activation 和 sd_notify
+//
+// 不依赖 libsystemd，按 sd_listen_fds(3) 和 sd_notify(3) 的协议实现。
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart 第一个继承的文件描述符 SD_LISTEN_FDS_START
+const listenFDsStart = 3
+
+// sd_notify 的状态
+const (
+	Ready    = "READY=1"    // 启动完成
+	Stopping = "STOPPING=1" // 开始停止
+)
+
+// ErrNoListeners 没有 systemd 传入的监听
+var ErrNoListeners = errors.New("no systemd socket activation listeners (LISTEN_FDS)")
+
+// Listener systemd 传入的监听
+type Listener struct {
+	net.Listener
+	Name string // FileDescriptorName=，没有设置时为 systemd 的默认名称
+}
+
+// Listeners 读取 LISTEN_PID、LISTEN_FDS 和 LISTEN_FDNAMES，返回 systemd 传入的监听。
+// 不是 socket activation 启动时返回空；读取后清除这些环境变量，避免子进程继承。
+func Listeners() ([]*Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	list := make([]*Listener, 0, n)
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		closeOnExec(fd)
+
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			for _, v := range list {
+				_ = v.Close()
+			}
+			return nil, fmt.Errorf("systemd listener %q failed, cause: %w", name, err)
+		}
+		list = append(list, &Listener{Listener: ln, Name: name})
+	}
+	return list, nil
+}
+
+// Notify 向 NOTIFY_SOCKET 发送状态，不是 systemd 的 Type=notify 服务时返回 false
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// 抽象的 unix socket
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("sd_notify dial failed, cause: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("sd_notify write failed, cause: %w", err)
+	}
+	return true, nil
+}
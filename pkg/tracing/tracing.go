@@ -0,0 +1,174 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing opentelemetry 链路追踪
+//
+// 没有调用 Setup 时使用 otel 默认的空实现，创建 span 几乎没有开销。
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/lenye/aichat/pkg/project"
+	"github.com/lenye/aichat/pkg/version"
+)
+
+// instrumentationName tracer 的名称
+const instrumentationName = "github.com/lenye/aichat"
+
+// 导出方式
+const (
+	ExporterNone   = "none"   // 不导出
+	ExporterStdout = "stdout" // 标准输出，每个 span 一行 json
+	ExporterFile   = "file"   // 追加写入文件，每个 span 一行 json
+	ExporterOTLP   = "otlp"   // otlp http/protobuf
+)
+
+// ValidExporter 是否支持的导出方式
+func ValidExporter(v string) bool {
+	switch strings.ToLower(v) {
+	case "", ExporterNone, ExporterStdout, ExporterFile, ExporterOTLP:
+		return true
+	}
+	return false
+}
+
+// Config 链路追踪配置
+type Config struct {
+	Exporter    string  // 导出方式，空为 ExporterNone
+	Endpoint    string  // otlp 的地址，如 http://localhost:4318，空时使用 OTEL_EXPORTER_OTLP_* 环境变量
+	File        string  // file 导出的文件
+	SampleRatio float64 // 采样比例，0~1；有上游 span 时跟随上游的采样
+}
+
+// Setup 创建并设置全局的 TracerProvider 和 w3c trace context 传播。
+// 返回的 shutdown 在退出前调用，导出还没有发送的 span。
+func Setup(ctx context.Context, cfg Config) (shutdown func(context.Context) error, err error) {
+	var (
+		exporter sdktrace.SpanExporter
+		closer   io.Closer
+	)
+	switch strings.ToLower(cfg.Exporter) {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		var f *os.File
+		f, err = os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, project.ModePerm0644)
+		if err != nil {
+			return nil, fmt.Errorf("open trace file failed, cause: %w", err)
+		}
+		closer = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("invalid trace exporter: %q", cfg.Exporter)
+	}
+	if err != nil {
+		if closer != nil {
+			_ = closer.Close()
+		}
+		return nil, fmt.Errorf("create trace exporter failed, cause: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(version.AppName),
+		semconv.ServiceVersion(version.Version),
+	))
+	if err != nil {
+		// 只有 schema url 冲突时出错，使用默认的 resource
+		res = resource.Default()
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			err = errors.Join(err, closer.Close())
+		}
+		return err
+	}, nil
+}
+
+// Tracer aichat 的 tracer
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start 创建 span
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, opts...)
+}
+
+// TraceID 当前 span 的 trace id，没有采样的 span 为空
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() || !sc.IsSampled() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// Error 记录 span 的错误，category 为错误的类别
+func Error(span trace.Span, err error, category string) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	if category != "" {
+		span.SetAttributes(AttrErrorCategory.String(category))
+	}
+}
+
+// span 的属性，模型和 tokens 使用 gen_ai 语义约定
+var (
+	AttrModel            = attribute.Key("gen_ai.request.model")
+	AttrPromptTokens     = attribute.Key("gen_ai.usage.input_tokens")
+	AttrCompletionTokens = attribute.Key("gen_ai.usage.output_tokens")
+	AttrFinishReason     = attribute.Key("gen_ai.response.finish_reason")
+	AttrTTFT             = attribute.Key("aichat.time_to_first_token_ms")
+	AttrStream           = attribute.Key("aichat.stream")
+	AttrStreamID         = attribute.Key("aichat.stream_id")
+	AttrErrorCategory    = semconv.ErrorTypeKey
+)
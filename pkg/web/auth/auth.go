@@ -0,0 +1,146 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth web 登录认证
+//
+// 支持共享的静态密码、htpasswd 格式的 bcrypt 用户和 bearer token，
+// 登录后使用签名的会话 cookie。
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lenye/aichat/pkg/web/contextkey"
+)
+
+// GuestUser 共享密码登录的用户
+const GuestUser = "guest"
+
+// Authenticator 用户名和密码的校验
+type Authenticator interface {
+	// Authenticate 校验成功时返回用户名
+	Authenticate(user, password string) (string, bool)
+}
+
+// SharedPassword 共享的静态密码，登录的用户固定为 GuestUser。
+// 用户名只能为空或者 GuestUser，不能用共享密码冒充其他用户。
+type SharedPassword string
+
+func (p SharedPassword) Authenticate(user, password string) (string, bool) {
+	if p == "" || subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+		return "", false
+	}
+	if user != "" && user != GuestUser {
+		return "", false
+	}
+	return GuestUser, true
+}
+
+// Tokens bearer token 对应的用户名
+type Tokens map[string]string
+
+// ParseTokens 解析 "user:token" 列表
+func ParseTokens(list []string) (Tokens, error) {
+	v := make(Tokens, len(list))
+	for _, s := range list {
+		user, token, ok := strings.Cut(s, ":")
+		user, token = strings.TrimSpace(user), strings.TrimSpace(token)
+		if !ok || user == "" || token == "" {
+			return nil, errors.New("invalid token, want user:token")
+		}
+		if _, ok := v[token]; ok {
+			return nil, fmt.Errorf("duplicate token of user %q", user)
+		}
+		v[token] = user
+	}
+	return v, nil
+}
+
+// Lookup 常量时间比较全部 token，避免泄露 token 的内容
+func (t Tokens) Lookup(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	var found string
+	for k, user := range t {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(token)) == 1 {
+			found = user
+		}
+	}
+	return found, found != ""
+}
+
+// Auth 认证方式，Authenticators 和 Tokens 都为空时不需要登录
+type Auth struct {
+	Authenticators []Authenticator // 登录页面的用户名和密码，按顺序校验
+	Tokens         Tokens          // api 的 bearer token
+	Sessions       *Sessions       // 登录后的会话 cookie
+}
+
+// Enabled 是否需要登录
+func (a *Auth) Enabled() bool {
+	return a != nil && (len(a.Authenticators) > 0 || len(a.Tokens) > 0)
+}
+
+// Login 校验用户名和密码，成功时返回用户名
+func (a *Auth) Login(user, password string) (string, bool) {
+	if password == "" {
+		return "", false
+	}
+	for _, v := range a.Authenticators {
+		if name, ok := v.Authenticate(user, password); ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Token 校验 bearer token，成功时返回用户名
+func (a *Auth) Token(token string) (string, bool) {
+	return a.Tokens.Lookup(token)
+}
+
+var defaultAuth atomic.Value
+
+func init() {
+	defaultAuth.Store(&Auth{Sessions: NewSessions(nil, 0, false)})
+}
+
+// Default returns the default Auth.
+func Default() *Auth {
+	return defaultAuth.Load().(*Auth)
+}
+
+// SetDefault makes v the default Auth.
+func SetDefault(v *Auth) {
+	defaultAuth.Store(v)
+}
+
+var userCtxKey = contextkey.New("auth.user")
+
+// WithUser 已登录的用户
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userCtxKey, user)
+}
+
+// UserFromContext 已登录的用户，不需要登录时为空
+func UserFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(userCtxKey).(string)
+	return v
+}
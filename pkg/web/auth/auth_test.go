@@ -0,0 +1,53 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSharedPasswordCannotImpersonate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("alice-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Auth{
+		Authenticators: []Authenticator{
+			SharedPassword("shared"),
+			Htpasswd{"alice": hash},
+		},
+	}
+
+	tests := []struct {
+		user, password string
+		want           string
+		ok             bool
+	}{
+		{"alice", "shared", "", false},
+		{"mallory", "shared", "", false},
+		{"", "shared", GuestUser, true},
+		{GuestUser, "shared", GuestUser, true},
+		{"alice", "alice-secret", "alice", true},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := a.Login(tt.user, tt.password)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Login(%q, %q) = %q, %v; want %q, %v", tt.user, tt.password, got, ok, tt.want, tt.ok)
+		}
+	}
+}
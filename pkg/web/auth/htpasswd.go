@@ -0,0 +1,81 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash 用户不存在时也做一次 bcrypt 比较，避免通过响应时间判断用户是否存在
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("aichat"), bcrypt.DefaultCost)
+	return hash
+})
+
+// Htpasswd htpasswd 格式的用户，只支持 bcrypt: htpasswd -B
+type Htpasswd map[string][]byte
+
+// LoadHtpasswd 读取 htpasswd 文件
+func LoadHtpasswd(name string) (Htpasswd, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseHtpasswd(f)
+}
+
+// ParseHtpasswd 解析 htpasswd，每行 user:hash，忽略空行和 # 开头的注释
+func ParseHtpasswd(r io.Reader) (Htpasswd, error) {
+	v := make(Htpasswd)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: want user:hash", n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: user %q is not a bcrypt hash, use htpasswd -B", n, user)
+		}
+		v[user] = []byte(hash)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (h Htpasswd) Authenticate(user, password string) (string, bool) {
+	hash, ok := h[user]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return "", false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", false
+	}
+	return user, true
+}
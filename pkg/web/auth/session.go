@@ -0,0 +1,122 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SessionCookie     = "aichat_session"
+	DefaultSessionTTL = 7 * 24 * time.Hour
+)
+
+// processKey 没有配置签名密钥时使用的随机密钥，重启后之前的会话失效
+var processKey = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// Sessions 签名的会话 cookie: base64(user).expires.base64(hmac-sha256)
+type Sessions struct {
+	key    []byte
+	ttl    time.Duration
+	secure bool // 只在 https 下发送 cookie
+}
+
+// NewSessions key 为空时使用进程的随机密钥，ttl<=0 时为 DefaultSessionTTL
+func NewSessions(key []byte, ttl time.Duration, secure bool) *Sessions {
+	if len(key) == 0 {
+		key = processKey
+	}
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	return &Sessions{key: key, ttl: ttl, secure: secure}
+}
+
+func (s *Sessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue 登录成功，设置会话 cookie
+func (s *Sessions) Issue(w http.ResponseWriter, user string) {
+	expires := time.Now().Add(s.ttl)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    payload + "." + s.sign(payload),
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(s.ttl.Seconds()),
+		Secure:   s.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// User 校验会话 cookie，返回已登录的用户
+func (s *Sessions) User(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return "", false
+	}
+	i := strings.LastIndexByte(cookie.Value, '.')
+	if i < 0 {
+		return "", false
+	}
+	payload, sig := cookie.Value[:i], cookie.Value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return "", false
+	}
+	enc, exp, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	user, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || len(user) == 0 {
+		return "", false
+	}
+	return string(user), true
+}
+
+// Clear 退出登录，删除会话 cookie
+func (s *Sessions) Clear(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   s.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,232 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package certs web server 的 tls 证书，证书文件变化时自动重新加载
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 客户端证书的校验方式
+const (
+	ClientAuthRequire  = "require"  // 必须提供客户端证书
+	ClientAuthOptional = "optional" // 提供客户端证书时校验
+)
+
+// ParseMinVersion 解析 tls 最低版本: 1.0, 1.1, 1.2, 1.3
+func ParseMinVersion(v string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(v), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "", "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid tls version: %q, want 1.0, 1.1, 1.2, 1.3", v)
+}
+
+// ValidClientAuth 是否支持的客户端证书校验方式
+func ValidClientAuth(v string) bool {
+	switch strings.ToLower(v) {
+	case "", ClientAuthRequire, ClientAuthOptional:
+		return true
+	}
+	return false
+}
+
+// Config tls 配置
+type Config struct {
+	CertFile   string // 证书，可以包含中间证书
+	KeyFile    string // 私钥
+	MinVersion string // 最低版本，默认 1.2
+	ClientCA   string // 校验客户端证书的 ca 证书，为空时不校验客户端证书
+	ClientAuth string // 客户端证书的校验方式，默认 ClientAuthRequire
+}
+
+// Reloader 加载证书和客户端 ca，文件变化时重新加载；加载失败时继续使用原来的证书
+type Reloader struct {
+	cfg Config
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// NewReloader 加载证书和客户端 ca
+func NewReloader(cfg Config) (*Reloader, error) {
+	r := &Reloader{cfg: cfg}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCA != "" {
+		files = append(files, r.cfg.ClientCA)
+	}
+	return files
+}
+
+func (r *Reloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, name := range r.files() {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return fmt.Errorf("stat tls file failed, cause: %w", err)
+		}
+		modTimes[name] = fi.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load tls certificate failed, cause: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if r.cfg.ClientCA != "" {
+		b, err := os.ReadFile(r.cfg.ClientCA)
+		if err != nil {
+			return fmt.Errorf("read client ca failed, cause: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("client ca %q contains no pem certificate", r.cfg.ClientCA)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCA = pool
+	r.modTimes = modTimes
+	return nil
+}
+
+// changed 证书文件的修改时间是否变化
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, name := range r.files() {
+		fi, err := os.Stat(name)
+		if err != nil {
+			// 替换文件的过程中可能暂时不存在，下次再检查
+			return false
+		}
+		if !fi.ModTime().Equal(r.modTimes[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch 每隔 interval 检查证书文件，变化时重新加载，直到 ctx 结束
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.load(); err != nil {
+				logger.Error("reload tls certificate failed, keep the old one",
+					"error", err,
+				)
+				continue
+			}
+			logger.Info("tls certificate reloaded",
+				"cert", r.cfg.CertFile,
+			)
+		}
+	}
+}
+
+// GetCertificate tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ClientCAs 当前的客户端 ca
+func (r *Reloader) ClientCAs() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.clientCA
+}
+
+// TLSConfig web server 的 tls 配置，每次握手使用当前的证书和客户端 ca
+func (r *Reloader) TLSConfig() (*tls.Config, error) {
+	minVersion, err := ParseMinVersion(r.cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	base := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: r.GetCertificate,
+		// GetConfigForClient 返回的配置替换 http.Server 设置的 NextProtos，需要自己设置
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if r.cfg.ClientCA == "" {
+		return base, nil
+	}
+
+	switch strings.ToLower(r.cfg.ClientAuth) {
+	case "", ClientAuthRequire:
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	case ClientAuthOptional:
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, errors.New("invalid client auth: " + r.cfg.ClientAuth)
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = r.ClientCAs()
+		return c, nil
+	}
+	return base, nil
+}
+
+// ClientUser 已校验的客户端证书的用户: subject 的 CN，没有 CN 时为完整的 subject
+func ClientUser(req *http.Request) (string, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	subject := req.TLS.VerifiedChains[0][0].Subject
+	if subject.CommonName != "" {
+		return subject.CommonName, true
+	}
+	return subject.String(), subject.String() != ""
+}
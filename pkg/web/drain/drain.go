@@ -0,0 +1,121 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package drain 停止服务前等待进行中的聊天结束
+//
+// 开始 drain 后不再接受新的聊天，/readyz 返回 503，
+// Drain 等待进行中的聊天全部结束或者超过期限。
+package drain
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+var defaultTracker atomic.Value
+
+func init() {
+	defaultTracker.Store(New())
+}
+
+func Default() *Tracker {
+	return defaultTracker.Load().(*Tracker)
+}
+
+func SetDefault(v *Tracker) {
+	defaultTracker.Store(v)
+}
+
+// Tracker 记录进行中的聊天
+type Tracker struct {
+	mu       sync.Mutex
+	draining bool
+	active   int
+	idle     chan struct{} // 进行中的聊天全部结束时关闭，drain 时创建
+}
+
+func New() *Tracker {
+	return new(Tracker)
+}
+
+// Acquire 开始一个聊天，结束时调用 release；drain 中返回 ok=false
+func (t *Tracker) Acquire() (release func(), ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return nil, false
+	}
+	t.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(t.release)
+	}, true
+}
+
+func (t *Tracker) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active--
+	if t.active == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// Draining 是否已经开始 drain
+func (t *Tracker) Draining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// Active 进行中的聊天数
+func (t *Tracker) Active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+// Start 开始 drain，不再接受新的聊天
+func (t *Tracker) Start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+}
+
+// Drain 开始 drain 并等待进行中的聊天全部结束，ctx 结束时返回 ctx.Err()
+func (t *Tracker) Drain(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	if t.active == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics prometheus 指标: http 请求和 sse 的指标在这里定义，
+// 其它指标由各自的包定义，用 MustRegister 注册。
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/lenye/aichat/pkg/web/contextkey"
+	"github.com/lenye/aichat/pkg/web/sse"
+)
+
+// Namespace 指标名称的前缀
+const Namespace = "aichat"
+
+// unmatchedRoute 没有匹配任何路由的请求，如 404
+const unmatchedRoute = "unmatched"
+
+var registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by route and status.",
+	}, []string{"route", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by route, sse streams last until the client disconnects.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Subsystem: "sse",
+			Name:      "streams",
+			Help:      "Active sse streams.",
+		}, func() float64 {
+			return float64(sse.Default().StreamCount())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Subsystem: "sse",
+			Name:      "subscribers",
+			Help:      "Connected sse subscribers of all streams.",
+		}, func() float64 {
+			return float64(sse.Default().SubscriberCount())
+		}),
+	)
+}
+
+// MustRegister 注册指标，重复注册时 panic
+func MustRegister(cs ...prometheus.Collector) {
+	registry.MustRegister(cs...)
+}
+
+// Handler 以 prometheus 文本格式输出全部指标
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// ObserveHTTP 记录一个 http 请求，status 为 0 时是没有调用 WriteHeader 的 200
+func ObserveHTTP(route string, status int, d time.Duration) {
+	if route == "" {
+		route = unmatchedRoute
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	httpRequests.WithLabelValues(route, strconv.Itoa(status)).Inc()
+	httpDuration.WithLabelValues(route).Observe(d.Seconds())
+}
+
+var routeCtxKey = contextkey.New("metrics.route")
+
+// WithRoute 请求匹配的路由，如 POST /chat/msg
+func WithRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, routeCtxKey, route)
+}
+
+// RouteFromContext 请求匹配的路由，没有匹配时为空
+func RouteFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(routeCtxKey).(string)
+	return v
+}
+
+// Routes 在请求的 context 中记录 mux 匹配的路由，指标按路由而不是 url 统计
+func Routes(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		mux.ServeHTTP(w, r.WithContext(WithRoute(r.Context(), pattern)))
+	})
+}
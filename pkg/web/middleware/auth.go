@@ -0,0 +1,74 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lenye/aichat/pkg/web/auth"
+	"github.com/lenye/aichat/pkg/web/certs"
+	"github.com/lenye/aichat/pkg/web/render"
+)
+
+// Auth 登录校验，auth.Default() 未启用时直接放行。
+//
+// https 客户端证书已校验时，证书的用户就是登录的用户；
+// 否则先校验 Authorization: Bearer <token>，再校验会话 cookie；都没有时，
+// 页面请求跳转到 loginPath，htmx 请求返回 HX-Redirect，其它请求返回 401。
+func Auth(loginPath string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user, ok := certs.ClientUser(r); ok {
+				next.ServeHTTP(w, r.WithContext(auth.WithUser(r.Context(), user)))
+				return
+			}
+
+			a := auth.Default()
+			if !a.Enabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+				user, ok := a.Token(strings.TrimSpace(token))
+				if !ok {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					render.JSONError(w, r, http.StatusUnauthorized, render.CodeUnauthorized, "invalid token")
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(auth.WithUser(r.Context(), user)))
+				return
+			}
+
+			if user, ok := a.Sessions.User(r); ok {
+				next.ServeHTTP(w, r.WithContext(auth.WithUser(r.Context(), user)))
+				return
+			}
+
+			switch {
+			case r.Header.Get("HX-Request") == "true":
+				w.Header().Set("HX-Redirect", loginPath)
+				w.WriteHeader(http.StatusUnauthorized)
+			case r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), render.HdrHtml):
+				http.Redirect(w, r, loginPath+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			default:
+				w.Header().Set("WWW-Authenticate", `Bearer realm="aichat"`)
+				render.JSONError(w, r, http.StatusUnauthorized, render.CodeUnauthorized, "login required")
+			}
+		})
+	}
+}
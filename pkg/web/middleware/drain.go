@@ -0,0 +1,43 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/lenye/aichat/pkg/web/drain"
+	"github.com/lenye/aichat/pkg/web/logging"
+)
+
+// drainRetryAfter 拒绝时的 Retry-After 秒数
+const drainRetryAfter = "5"
+
+// Drain 记录进行中的聊天，停止服务的 drain 期间用 refuse 拒绝新的聊天并设置 Retry-After
+func Drain(refuse http.HandlerFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			release, ok := drain.Default().Acquire()
+			if !ok {
+				logging.FromContext(r.Context()).Info("chat refused, server is draining")
+				w.Header().Set("Retry-After", drainRetryAfter)
+				refuse(w, r)
+				return
+			}
+			defer release()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -17,36 +17,90 @@ package middleware
 import (
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/lenye/aichat/pkg/tracing"
 	"github.com/lenye/aichat/pkg/web"
 	"github.com/lenye/aichat/pkg/web/logging"
+	"github.com/lenye/aichat/pkg/web/metrics"
 	"github.com/lenye/aichat/pkg/web/realip"
 )
 
-// AccessLog 访问日志
+// AccessLog 访问日志、http 指标和请求的 span。
+//
+// 请求头有 w3c traceparent 时，span 接在上游的链路之后；logger 带有 trace_id，和 span 对应。
 func AccessLog(name string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
 			ww := web.NewResponseWriterWrapper(w)
-			ctx := r.Context()
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+			route := metrics.RouteFromContext(ctx)
+			ip := realip.ClientIP(r)
+			ctx, span := tracing.Start(ctx, spanName(r, route),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					semconv.HTTPRequestMethodKey.String(r.Method),
+					semconv.URLPath(r.URL.Path),
+					semconv.ClientAddress(ip),
+					semconv.UserAgentOriginal(r.UserAgent()),
+				),
+			)
+			defer span.End()
+			if _, path, ok := strings.Cut(route, " "); ok {
+				span.SetAttributes(semconv.HTTPRoute(path))
+			}
 
 			// logger
 			logger := slog.Default().WithGroup(name)
+			if traceID := tracing.TraceID(ctx); traceID != "" {
+				logger = logger.With("trace_id", traceID)
+			}
 
 			ctx = logging.WithContext(ctx, logger)
 			next.ServeHTTP(ww, r.WithContext(ctx))
 
+			duration := time.Since(start)
+			metrics.ObserveHTTP(route, ww.StatusCode, duration)
+
+			status := ww.StatusCode
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+
 			logger.Info("access",
-				"duration", time.Since(start),
+				"duration", duration,
 				"status", ww.StatusCode,
 				"method", r.Method,
 				"url", r.URL,
 				"size", ww.ContentLength,
-				"ip", realip.ClientIP(r),
+				"ip", ip,
 				"user_agent", r.UserAgent(),
 			)
 		})
 	}
 }
+
+// spanName 请求的 span 名称: 方法 路由，没有匹配路由时只有方法
+func spanName(r *http.Request, route string) string {
+	switch {
+	case route == "":
+		return r.Method
+	case strings.Contains(route, " "):
+		return route
+	default:
+		return r.Method + " " + route
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/lenye/aichat/pkg/web/auth"
+	"github.com/lenye/aichat/pkg/web/logging"
+	"github.com/lenye/aichat/pkg/web/ratelimit"
+	"github.com/lenye/aichat/pkg/web/realip"
+	"github.com/lenye/aichat/pkg/web/render"
+)
+
+// RateLimit 按 ratelimit.Default() 的规则限制路由 route 的请求，没有规则时直接放行。
+//
+// 登录的用户按用户名限制，否则按客户端 ip 限制，因此要放在 Auth 之后；
+// 超过限制时返回 429 和 Retry-After。
+func RateLimit(route string) func(http.Handler) http.Handler {
+	return rateLimit(route, true)
+}
+
+// RateLimitRequests 与 RateLimit 相同，但只限制每分钟的请求数，不占用并发数。
+// 用于持续到客户端断开的长连接，例如 sse 订阅，否则长连接会一直占用并发数，使聊天请求超过限制。
+func RateLimitRequests(route string) func(http.Handler) http.Handler {
+	return rateLimit(route, false)
+}
+
+func rateLimit(route string, stream bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			l := ratelimit.Default()
+			if !l.Enabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := r.Context()
+			user := auth.UserFromContext(ctx)
+			ip := realip.ClientIP(r)
+			var (
+				t   *ratelimit.Ticket
+				err error
+			)
+			if stream {
+				t, err = l.Allow(route, user, ip)
+			} else {
+				err = l.AllowRequest(route, user, ip)
+			}
+			if err != nil {
+				var limitErr *ratelimit.LimitError
+				if !errors.As(err, &limitErr) {
+					render.Html500(w, r, err)
+					return
+				}
+				logging.FromContext(ctx).Warn("rate limited",
+					"route", route,
+					"user", user,
+					"ip", ip,
+					"group", l.Group(user),
+					"limit", limitErr.Limit,
+					"retry_after", limitErr.RetryAfter,
+				)
+				rateLimited(w, r, limitErr)
+				return
+			}
+			if t == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			defer t.Release()
+
+			next.ServeHTTP(w, r.WithContext(ratelimit.WithTicket(ctx, t)))
+		})
+	}
+}
+
+func rateLimited(w http.ResponseWriter, r *http.Request, err *ratelimit.LimitError) {
+	seconds := int(math.Ceil(err.RetryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	var msg string
+	switch err.Limit {
+	case ratelimit.LimitTokens:
+		msg = "今天的 tokens 额度已用完，请 " + strconv.Itoa(seconds) + " 秒后再试"
+	case ratelimit.LimitStreams:
+		msg = "同时进行的聊天太多，请等待其它聊天结束"
+	default:
+		msg = "请求太频繁，请 " + strconv.Itoa(seconds) + " 秒后再试"
+	}
+	code := http.StatusTooManyRequests
+	render.HtmlStatus(w, r, code, "429.gohtml", map[string]string{
+		"title": http.StatusText(code),
+		"error": msg,
+	})
+}
@@ -19,6 +19,7 @@ import (
 
 	"github.com/lenye/aichat/pkg/project"
 	"github.com/lenye/aichat/pkg/version"
+	"github.com/lenye/aichat/pkg/web/auth"
 	"github.com/lenye/aichat/pkg/web/templatemap"
 )
 
@@ -35,6 +36,7 @@ func TemplateMap(next http.Handler) http.Handler {
 
 		m["mode"] = project.DevMode()
 		m["requestUrl"] = r.URL.String()
+		m["user"] = auth.UserFromContext(ctx)
 
 		ctx = templatemap.WithContext(ctx, m)
 		next.ServeHTTP(w, r.WithContext(ctx))
@@ -0,0 +1,386 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ratelimit 按客户端（登录的用户，不需要登录时为 ip）限流:
+// 每分钟的请求数、每天的 tokens 数用令牌桶，并发数用计数。
+//
+// 规则按用户组和路由配置，一个请求要满足它所在用户组的全部匹配规则。
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lenye/aichat/pkg/web/contextkey"
+)
+
+// DefaultGroup 没有加入任何用户组的用户和未登录的客户端
+const DefaultGroup = "default"
+
+// 超过限制的类型
+const (
+	LimitRequests = "requests" // 每分钟的请求数
+	LimitTokens   = "tokens"   // 每天的 tokens 数
+	LimitStreams  = "streams"  // 并发数
+)
+
+const (
+	requestWindow = time.Minute
+	tokenWindow   = 24 * time.Hour
+
+	// streamRetryAfter 并发数超过限制时建议的重试间隔，无法知道其它请求什么时候结束
+	streamRetryAfter = 5 * time.Second
+
+	// sweepInterval 清理额度已经恢复的客户端的间隔
+	sweepInterval = 10 * time.Minute
+)
+
+// Group 用户组
+type Group struct {
+	Name  string
+	Users []string
+}
+
+// Rule 一个用户组在一个路由上的限制，为 0 的项不限制
+type Rule struct {
+	Group    string // 用户组，空为 DefaultGroup
+	Route    string // 路由，如 /chat/msg；空为全部限流的路由共用一份额度
+	Requests int64  // 每分钟的请求数
+	Tokens   int64  // 每天的 tokens 数，聊天结束后按用量扣除
+	Streams  int64  // 并发数
+}
+
+func (r *Rule) key() string {
+	return r.Group + " " + r.Route
+}
+
+// LimitError 超过限制
+type LimitError struct {
+	Limit      string        // 超过的限制: LimitRequests, LimitTokens, LimitStreams
+	RetryAfter time.Duration // 建议的重试间隔
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded: %s, retry after %s", e.Limit, e.RetryAfter)
+}
+
+// bucket 令牌桶，容量为 capacity，匀速补充，每个 window 补满
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(capacity float64, window time.Duration, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else if d := now.Sub(b.last); d > 0 {
+		b.tokens = min(capacity, b.tokens+capacity*float64(d)/float64(window))
+	}
+	b.last = now
+}
+
+// wait 桶里至少有 1 个令牌需要等待的时间；tokens 按用量扣除，可以是负数
+func (b *bucket) wait(capacity float64, window time.Duration) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / capacity * float64(window))
+}
+
+// client 一个客户端在一条规则上的额度
+type client struct {
+	requests bucket
+	tokens   bucket
+	streams  int64
+}
+
+type rule struct {
+	Rule
+	clients map[string]*client
+}
+
+// refill 补充令牌
+func (r *rule) refill(c *client, now time.Time) {
+	if r.Requests > 0 {
+		c.requests.refill(float64(r.Requests), requestWindow, now)
+	}
+	if r.Tokens > 0 {
+		c.tokens.refill(float64(r.Tokens), tokenWindow, now)
+	}
+}
+
+// check 客户端 c 是否可以再发起一个请求，stream=false 时只检查每分钟的请求数
+func (r *rule) check(c *client, stream bool) *LimitError {
+	if stream && r.Streams > 0 && c.streams >= r.Streams {
+		return &LimitError{Limit: LimitStreams, RetryAfter: streamRetryAfter}
+	}
+	if stream && r.Tokens > 0 {
+		if d := c.tokens.wait(float64(r.Tokens), tokenWindow); d > 0 {
+			return &LimitError{Limit: LimitTokens, RetryAfter: d}
+		}
+	}
+	if r.Requests > 0 {
+		if d := c.requests.wait(float64(r.Requests), requestWindow); d > 0 {
+			return &LimitError{Limit: LimitRequests, RetryAfter: d}
+		}
+	}
+	return nil
+}
+
+// idle 额度已经全部恢复，删除后等同于新的客户端
+func (r *rule) idle(c *client) bool {
+	return c.streams == 0 &&
+		(r.Requests == 0 || c.requests.tokens >= float64(r.Requests)) &&
+		(r.Tokens == 0 || c.tokens.tokens >= float64(r.Tokens))
+}
+
+// Limiter 限流器
+type Limiter struct {
+	mu        sync.Mutex
+	groups    map[string]string // 用户 -> 用户组
+	rules     []*rule
+	lastSweep time.Time
+}
+
+// New 创建没有规则的限流器，不限制任何请求
+func New() *Limiter {
+	return &Limiter{groups: make(map[string]string)}
+}
+
+// Configure 替换用户组和规则。用户组和路由相同的规则保留客户端已经使用的额度，
+// 重新加载配置时不会重置限制。
+func (l *Limiter) Configure(groups []Group, rules []Rule) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.groups = make(map[string]string)
+	for _, g := range groups {
+		for _, user := range g.Users {
+			if _, ok := l.groups[user]; !ok {
+				l.groups[user] = g.Name
+			}
+		}
+	}
+
+	old := make(map[string]*rule, len(l.rules))
+	for _, r := range l.rules {
+		old[r.key()] = r
+	}
+	list := make([]*rule, 0, len(rules))
+	for _, v := range rules {
+		if v.Group == "" {
+			v.Group = DefaultGroup
+		}
+		r := &rule{Rule: v, clients: make(map[string]*client)}
+		if o, ok := old[r.key()]; ok {
+			r.clients = o.clients
+		}
+		list = append(list, r)
+	}
+	l.rules = list
+}
+
+// Enabled 是否配置了规则
+func (l *Limiter) Enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.rules) > 0
+}
+
+// Group 用户所在的用户组
+func (l *Limiter) Group(user string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.group(user)
+}
+
+func (l *Limiter) group(user string) string {
+	if g, ok := l.groups[user]; ok && user != "" {
+		return g
+	}
+	return DefaultGroup
+}
+
+// Allow 客户端在路由 route 上发起一个请求。user 为登录的用户，为空时按 ip 限制。
+//
+// 超过任意一条规则的限制时返回 *LimitError，否则返回的 Ticket 在请求结束时要 Release。
+func (l *Limiter) Allow(route, user, ip string) (*Ticket, error) {
+	return l.allow(route, user, ip, true)
+}
+
+// AllowRequest 与 Allow 相同，但只检查和扣除每分钟的请求数，不占用并发数，也不检查 tokens 数；
+// 用于持续到客户端断开的长连接（如 sse 订阅），避免长连接一直占用并发数。
+// 超过限制时返回 *LimitError。
+func (l *Limiter) AllowRequest(route, user, ip string) error {
+	_, err := l.allow(route, user, ip, false)
+	return err
+}
+
+func (l *Limiter) allow(route, user, ip string, stream bool) (*Ticket, error) {
+	key := "ip:" + ip
+	if user != "" {
+		key = "user:" + user
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	group := l.group(user)
+	t := &Ticket{l: l}
+	var limitErr *LimitError
+	for _, r := range l.rules {
+		if r.Group != group || (r.Route != "" && r.Route != route) {
+			continue
+		}
+		c, ok := r.clients[key]
+		if !ok {
+			c = new(client)
+			r.clients[key] = c
+		}
+		r.refill(c, now)
+		if err := r.check(c, stream); err != nil {
+			if limitErr == nil || err.RetryAfter > limitErr.RetryAfter {
+				limitErr = err
+			}
+			continue
+		}
+		t.entries = append(t.entries, ticketEntry{rule: r, client: c})
+	}
+	if limitErr != nil {
+		return nil, limitErr
+	}
+
+	for _, e := range t.entries {
+		if e.rule.Requests > 0 {
+			e.client.requests.tokens--
+		}
+		if stream {
+			e.client.streams++
+		}
+	}
+	return t, nil
+}
+
+// sweep 删除额度已经全部恢复的客户端
+func (l *Limiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for _, r := range l.rules {
+		for key, c := range r.clients {
+			r.refill(c, now)
+			if r.idle(c) {
+				delete(r.clients, key)
+			}
+		}
+	}
+}
+
+type ticketEntry struct {
+	rule   *rule
+	client *client
+}
+
+// Ticket 一个通过限流的请求
+type Ticket struct {
+	l        *Limiter
+	entries  []ticketEntry
+	released atomic.Bool
+}
+
+// Metered 是否有每天 tokens 数的限制，需要在聊天结束后调用 Consume
+func (t *Ticket) Metered() bool {
+	for _, e := range t.entries {
+		if e.rule.Tokens > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Consume 扣除一次聊天的 tokens 用量
+func (t *Ticket) Consume(tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	t.l.mu.Lock()
+	defer t.l.mu.Unlock()
+	now := time.Now()
+	for _, e := range t.entries {
+		if e.rule.Tokens > 0 {
+			e.rule.refill(e.client, now)
+			e.client.tokens.tokens -= float64(tokens)
+		}
+	}
+}
+
+// Release 请求结束，减少并发数，可以重复调用
+func (t *Ticket) Release() {
+	if t.released.Swap(true) {
+		return
+	}
+	t.l.mu.Lock()
+	defer t.l.mu.Unlock()
+	for _, e := range t.entries {
+		e.client.streams--
+	}
+}
+
+var ticketCtxKey = contextkey.New("ratelimit.ticket")
+
+// WithTicket 请求通过限流的 Ticket
+func WithTicket(ctx context.Context, t *Ticket) context.Context {
+	return context.WithValue(ctx, ticketCtxKey, t)
+}
+
+// FromContext 请求通过限流的 Ticket，没有限流时为 nil
+func FromContext(ctx context.Context) *Ticket {
+	t, _ := ctx.Value(ticketCtxKey).(*Ticket)
+	return t
+}
+
+// Metered 请求是否有每天 tokens 数的限制
+func Metered(ctx context.Context) bool {
+	t := FromContext(ctx)
+	return t != nil && t.Metered()
+}
+
+// Consume 从请求的每天 tokens 额度中扣除用量，没有限制时不做任何事
+func Consume(ctx context.Context, tokens int) {
+	if t := FromContext(ctx); t != nil {
+		t.Consume(tokens)
+	}
+}
+
+var defaultLimiter atomic.Value
+
+func init() {
+	defaultLimiter.Store(New())
+}
+
+// Default returns the default Limiter.
+func Default() *Limiter {
+	return defaultLimiter.Load().(*Limiter)
+}
+
+// SetDefault makes v the default Limiter.
+func SetDefault(v *Limiter) {
+	defaultLimiter.Store(v)
+}
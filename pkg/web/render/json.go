@@ -0,0 +1,142 @@
+// Copyright 2023-2024 The aichat Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/lenye/aichat/pkg/web/logging"
+)
+
+const HdrJSON = "application/json"
+
+// 错误代码
+const (
+	CodeBadRequest   = "bad_request"
+	CodeUnauthorized = "unauthorized"
+	CodeNotFound     = "not_found"
+	CodeConflict     = "conflict"
+	CodeUpstream     = "upstream_error"
+	CodeInternal     = "internal_error"
+	CodeUnsupported  = "unsupported"
+	CodeUnavailable  = "unavailable"
+)
+
+// ErrorBody 结构化的错误
+type ErrorBody struct {
+	Code    string `json:"code"`    // 错误代码，供程序判断
+	Message string `json:"message"` // 错误说明
+}
+
+// errorResponse 错误响应: {"error": {"code": "...", "message": "..."}}
+type errorResponse struct {
+	Error *ErrorBody `json:"error"`
+}
+
+// JSON calls JSONStatus with a http.StatusOK (200).
+func JSON(w http.ResponseWriter, r *http.Request, data any) {
+	JSONStatus(w, r, http.StatusOK, data)
+}
+
+// JSONStatus renders the given data as JSON. Like HtmlStatus, the data is
+// encoded into a buffer first, so an encoding error results in a 500 error
+// body instead of a partial response.
+func JSONStatus(w http.ResponseWriter, r *http.Request, statusCode int, data any) {
+	writeNoCacheResponseContentType(w, HdrJSON)
+	ctx := r.Context()
+
+	if !AllowedResponseCode(statusCode) {
+		logging.FromContext(ctx).Error("unregistered response statusCode",
+			"statusCode", statusCode,
+			"func", "JSONStatus",
+		)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJSONErr(w, r, CodeInternal, fmt.Sprintf("%d is not a registered response statusCode", statusCode))
+		return
+	}
+
+	// Acquire a renderer
+	b := rendererPool.Get().(*bytes.Buffer)
+	b.Reset()
+	defer rendererPool.Put(b)
+
+	if err := json.NewEncoder(b).Encode(data); err != nil {
+		logging.FromContext(ctx).Error("failed to encode json",
+			"error", err,
+			"func", "JSONStatus",
+		)
+
+		msg := "An internal error occurred."
+		if isDebug {
+			msg = err.Error()
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJSONErr(w, r, CodeInternal, msg)
+		return
+	}
+
+	w.WriteHeader(statusCode)
+	if _, err := b.WriteTo(w); err != nil {
+		logging.FromContext(ctx).Error("failed to write json to response",
+			"error", err,
+			"func", "JSONStatus",
+		)
+	}
+}
+
+// JSONError renders a structured error body with the given status code.
+func JSONError(w http.ResponseWriter, r *http.Request, statusCode int, code, message string) {
+	JSONStatus(w, r, statusCode, &errorResponse{Error: &ErrorBody{
+		Code:    code,
+		Message: message,
+	}})
+}
+
+// JSON500 renders the given error as a JSON error body. In production mode,
+// this always renders a generic "server error" message. In isDebug, it returns
+// the actual error from the caller.
+func JSON500(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	msg := http.StatusText(code)
+
+	if isDebug {
+		msg = err.Error()
+	}
+	JSONError(w, r, code, CodeInternal, msg)
+}
+
+// JSONNoContent sets 204 status code
+func JSONNoContent(w http.ResponseWriter) {
+	writeNoCacheResponseContentType(w, HdrJSON)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSONErr writes the error body directly, it is used when the regular
+// rendering failed.
+func writeJSONErr(w http.ResponseWriter, r *http.Request, code, message string) {
+	if err := json.NewEncoder(w).Encode(&errorResponse{Error: &ErrorBody{
+		Code:    code,
+		Message: message,
+	}}); err != nil {
+		logging.FromContext(r.Context()).Error("failed to write json to response",
+			"error", err,
+			"func", "JSONStatus",
+		)
+	}
+}
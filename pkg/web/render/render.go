@@ -68,8 +68,11 @@ func writeNoCacheResponseContentType(w http.ResponseWriter, value string) {
 // bad status code.
 var allowedResponseCodes = map[int]struct{}{
 	http.StatusOK:                    {},
+	http.StatusCreated:               {},
+	http.StatusNoContent:             {},
 	http.StatusBadRequest:            {},
 	http.StatusUnauthorized:          {},
+	http.StatusPaymentRequired:       {},
 	http.StatusNotFound:              {},
 	http.StatusMethodNotAllowed:      {},
 	http.StatusConflict:              {},
@@ -77,6 +80,9 @@ var allowedResponseCodes = map[int]struct{}{
 	http.StatusRequestEntityTooLarge: {},
 	http.StatusTooManyRequests:       {},
 	http.StatusInternalServerError:   {},
+	http.StatusBadGateway:            {},
+	http.StatusServiceUnavailable:    {},
+	http.StatusGatewayTimeout:        {},
 }
 
 // AllowedResponseCode returns true if the code is a permitted response code,
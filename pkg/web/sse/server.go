@@ -121,6 +121,25 @@ func (s *Server) StreamExists(id string) bool {
 	return s.getStream(id) != nil
 }
 
+// StreamCount returns the number of active streams.
+func (s *Server) StreamCount() int {
+	s.muStreams.RLock()
+	defer s.muStreams.RUnlock()
+	return len(s.streams)
+}
+
+// SubscriberCount returns the number of subscribers of all streams.
+func (s *Server) SubscriberCount() int {
+	s.muStreams.RLock()
+	defer s.muStreams.RUnlock()
+
+	n := 0
+	for _, str := range s.streams {
+		n += str.getSubscriberCount()
+	}
+	return n
+}
+
 // Publish sends a mesage to every client in a streamID.
 // If the stream's buffer is full, it blocks until the message is sent out to
 // all subscribers (but not necessarily arrived the clients), or when the
@@ -137,6 +156,22 @@ func (s *Server) Publish(id string, event *Event) {
 	}
 }
 
+// Broadcast sends a copy of the event to every stream, e.g. to notify all
+// clients before the server shuts down.
+func (s *Server) Broadcast(event *Event) {
+	s.muStreams.RLock()
+	ids := make([]string, 0, len(s.streams))
+	for id := range s.streams {
+		ids = append(ids, id)
+	}
+	s.muStreams.RUnlock()
+
+	for _, id := range ids {
+		e := *event
+		s.Publish(id, &e)
+	}
+}
+
 // TryPublish is the same as Publish except that when the operation would cause
 // the call to be blocked, it simply drops the message and returns false.
 // Together with a small BufferSize, it can be useful when publishing the